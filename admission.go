@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Uploads are admitted only while there's room for them: a bounded number
+// are taken in at once, and the disk they land on must keep minFreeBytes
+// free afterwards. Otherwise the client gets a 503 with Retry-After rather
+// than a server that grinds to a halt.
+
+type admissionConfig struct {
+	// scratchDir holds uploads and every intermediate file ffmpeg writes.
+	scratchDir   string
+	minFreeBytes int64
+	// uploadSlots bounds the uploads being received and validated at once.
+	uploadSlots chan struct{}
+	retryAfter  time.Duration
+}
+
+// acquireUploadSlot claims one of the upload slots without waiting. When
+// none is free it writes a 503 and reports false; otherwise the caller must
+// call release once the upload has been handed off.
+func (cfg *apiConfig) acquireUploadSlot(w http.ResponseWriter) (release func(), ok bool) {
+	select {
+	case cfg.admission.uploadSlots <- struct{}{}:
+		return func() { <-cfg.admission.uploadSlots }, true
+	default:
+		respondUnavailable(w, cfg.admission.retryAfter, "Too many uploads in progress, try again later")
+		return nil, false
+	}
+}
+
+// checkDiskSpace makes sure size more bytes fit in dir while leaving the
+// configured reserve free, writing a 503 and reporting false if not. An
+// unknown size, -1, is checked against the reserve alone.
+func (cfg *apiConfig) checkDiskSpace(w http.ResponseWriter, dir string, size int64) bool {
+	if err := cfg.hasDiskSpace(dir, size); err != nil {
+		log.Printf("Refused upload: %v", err)
+		respondUnavailable(w, cfg.admission.retryAfter, "Not enough disk space to accept this upload, try again later")
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) hasDiskSpace(dir string, size int64) error {
+	free, ok, err := freeDiskSpace(dir)
+	if err != nil {
+		// Better to accept an upload than to refuse them all because
+		// statfs failed.
+		log.Printf("Couldn't check free space in %s: %v", dir, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	needed := cfg.admission.minFreeBytes + max(size, 0)
+	if free < needed {
+		return fmt.Errorf("%s has %d bytes free, need %d", dir, free, needed)
+	}
+	return nil
+}
+
+func respondUnavailable(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	respondWithError(w, http.StatusServiceUnavailable, msg, nil)
+}
@@ -175,7 +175,8 @@ async function uploadVideoFile(videoID) {
       throw new Error(`Failed to upload video file. Error: ${data.error}`);
     }
 
-    console.log('Video uploaded!');
+    console.log('Video uploaded, waiting for processing...');
+    await waitForProcessing(videoID);
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
@@ -184,6 +185,29 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+function waitForProcessing(videoID) {
+  return new Promise((resolve, reject) => {
+    const events = new EventSource(`/api/videos/${videoID}/events`);
+    const onProgress = (e) => {
+      const event = JSON.parse(e.data);
+      if (event.percent !== undefined) {
+        const eta = event.eta_seconds !== undefined ? `, ~${event.eta_seconds}s left` : '';
+        console.log(`Processing (${event.stage}): ${event.percent}%${eta}`);
+      }
+    };
+    events.addEventListener('progress', onProgress);
+    events.addEventListener('uploaded', onProgress);
+    events.addEventListener('ready', () => {
+      events.close();
+      resolve();
+    });
+    events.addEventListener('failed', (e) => {
+      events.close();
+      reject(new Error(`Video processing failed. Error: ${JSON.parse(e.data).error}`));
+    });
+  });
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -262,6 +286,12 @@ function viewVideo(video) {
   } else {
     thumbnailImg.style.display = 'block';
     thumbnailImg.src = video.thumbnail_url;
+    const jpegs = video.thumbnails && video.thumbnails.jpeg;
+    if (jpegs) {
+      thumbnailImg.srcset = jpegs.srcset;
+    } else {
+      thumbnailImg.removeAttribute('srcset');
+    }
   }
 
   const videoPlayer = document.getElementById('video-player');
@@ -271,6 +301,8 @@ function viewVideo(video) {
     } else {
       videoPlayer.style.display = 'block';
       videoPlayer.src = video.video_url;
+      // Audio has no picture of its own; show the waveform while it plays.
+      videoPlayer.poster = video.media_kind === 'audio' && video.thumbnail_url ? video.thumbnail_url : '';
       videoPlayer.load();
     }
   }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Processed videos are stored under a prefix named after their aspect
+// ratio. Encoders pad or crop to macroblock sizes (1920x1088) and phones
+// store portrait video as rotated landscape, so classification works on
+// the display dimensions and accepts anything within a relative tolerance
+// of a bucket.
+
+const aspectRatioOther = "other"
+
+// reservedKeyPrefixes are the top-level key prefixes of everything that
+// isn't a processed video. A bucket renamed to one of them would mix its
+// videos' outputs in with files the cleanup code treats as something else.
+var reservedKeyPrefixes = []string{"uploads", "captions", "watermarks", database.MediaKindAudio}
+
+type aspectRatioBucket struct {
+	name  string
+	ratio float64 // width / height
+}
+
+var aspectRatioBuckets = []aspectRatioBucket{
+	{name: "landscape", ratio: 16.0 / 9},
+	{name: "portrait", ratio: 9.0 / 16},
+	{name: "square", ratio: 1},
+	{name: "standard", ratio: 4.0 / 3},
+	{name: "ultrawide", ratio: 21.0 / 9},
+}
+
+type aspectRatioConfig struct {
+	// tolerance is the largest relative difference from a bucket's ratio
+	// that still counts as a match, e.g. 0.02 for 2%.
+	tolerance float64
+	// prefixes renames buckets in object keys; unlisted buckets use their
+	// own name.
+	prefixes map[string]string
+}
+
+// newAspectRatioConfig checks that every renamed bucket exists.
+func newAspectRatioConfig(tolerance float64, prefixes map[string]string) (aspectRatioConfig, error) {
+	if tolerance < 0 || tolerance >= 1 {
+		return aspectRatioConfig{}, fmt.Errorf("tolerance must be between 0 and 1")
+	}
+	known := []string{aspectRatioOther}
+	for _, bucket := range aspectRatioBuckets {
+		known = append(known, bucket.name)
+	}
+	for name, prefix := range prefixes {
+		if !slices.Contains(known, name) {
+			return aspectRatioConfig{}, fmt.Errorf("unknown aspect ratio bucket %q, expected one of %s", name, strings.Join(known, ", "))
+		}
+		if validateObjectKey(prefix) != nil || path.Base(prefix) != prefix || slices.Contains(reservedKeyPrefixes, prefix) {
+			return aspectRatioConfig{}, fmt.Errorf("invalid prefix %q for bucket %q", prefix, name)
+		}
+	}
+	return aspectRatioConfig{tolerance: tolerance, prefixes: prefixes}, nil
+}
+
+// classify returns the name of the closest bucket within tolerance of
+// width/height, or "other".
+func (c aspectRatioConfig) classify(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return aspectRatioOther
+	}
+	ratio := float64(width) / float64(height)
+	best, bestDiff := aspectRatioOther, math.Inf(1)
+	for _, bucket := range aspectRatioBuckets {
+		diff := math.Abs(ratio-bucket.ratio) / bucket.ratio
+		if diff <= c.tolerance && diff < bestDiff {
+			best, bestDiff = bucket.name, diff
+		}
+	}
+	return best
+}
+
+func (c aspectRatioConfig) prefix(bucket string) string {
+	if prefix, ok := c.prefixes[bucket]; ok {
+		return prefix
+	}
+	return bucket
+}
+
+// keyPrefixes returns the key prefix of every bucket.
+func (c aspectRatioConfig) keyPrefixes() []string {
+	prefixes := []string{c.prefix(aspectRatioOther)}
+	for _, bucket := range aspectRatioBuckets {
+		prefixes = append(prefixes, c.prefix(bucket.name))
+	}
+	return prefixes
+}
+
+// getVideoAspectRatio returns the key prefix for the video at filePath,
+// based on its first video stream after rotation.
+func (cfg *apiConfig) getVideoAspectRatio(ctx context.Context, filePath string) (string, error) {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	video, ok := probe.firstStream("video")
+	if !ok {
+		return "", fmt.Errorf("no video stream")
+	}
+	width, height := video.displayDimensions()
+	bucket := cfg.processing.aspectRatio.classify(width, height)
+	return cfg.processing.aspectRatio.prefix(bucket), nil
+}
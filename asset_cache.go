@@ -0,0 +1,151 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assetCache keeps derived images on disk and evicts the least recently
+// used ones once the directory grows past maxBytes. The index lives in
+// memory and is rebuilt from file modification times at startup; hits
+// touch the file so the order survives restarts.
+type assetCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type assetCacheEntry struct {
+	key  string
+	size int64
+}
+
+func newAssetCache(dir string, maxBytes int64) (*assetCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &assetCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    map[string]*list.Element{},
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	files := []existing{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		files = append(files, existing{key: entry.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	for _, f := range files {
+		c.items[f.key] = c.order.PushBack(&assetCacheEntry{key: f.key, size: f.size})
+		c.size += f.size
+	}
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *assetCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// get returns a cached variant and marks it as recently used. It reads
+// the file under the lock so a concurrent eviction can't remove it midway.
+func (c *assetCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	p := c.path(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		// Removed behind our back.
+		c.removeLocked(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+// put stores data under key, evicting older variants as needed.
+func (c *assetCache) put(key string, data []byte) error {
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.size -= elem.Value.(*assetCacheEntry).size
+		c.order.Remove(elem)
+	}
+	size := int64(len(data))
+	c.items[key] = c.order.PushFront(&assetCacheEntry{key: key, size: size})
+	c.size += size
+	c.evictLocked()
+	return nil
+}
+
+func (c *assetCache) evictLocked() {
+	for c.size > c.maxBytes && c.order.Len() > 1 {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+func (c *assetCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*assetCacheEntry)
+	c.order.Remove(elem)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+	if err := os.Remove(c.path(entry.key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Couldn't evict cached asset %s: %v", entry.key, err)
+	}
+}
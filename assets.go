@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -31,6 +33,12 @@ func getAssetPathWithPrefix(mediaName, prefix string) string {
 	return fmt.Sprintf("%s/%s", prefix, mediaName)
 }
 
+// videoKeyPrefix groups every object belonging to a video under one
+// prefix, so it can be listed, deleted or cookie-signed as a unit.
+func videoKeyPrefix(ratio string, videoID uuid.UUID) string {
+	return fmt.Sprintf("%s/%s", ratio, videoID)
+}
+
 func getRandomAssetPathWithPrefix(mediaType, prefix string) string {
 	randBytes := make([]byte, 32)
 	_, err := rand.Read(randBytes)
@@ -54,6 +62,12 @@ func (cfg apiConfig) getAssetURL(assetPath string) string {
 	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
 }
 
+// getVideoStreamURL points at the manifest proxy for a video's adaptive
+// streams, e.g. route "hls" and rel "master.m3u8".
+func (cfg apiConfig) getVideoStreamURL(videoID uuid.UUID, route, rel string) string {
+	return fmt.Sprintf("http://localhost:%s/api/videos/%s/%s/%s", cfg.port, videoID, route, rel)
+}
+
 func mediaTypeToExt(mediaType string) string {
 	parts := strings.Split(mediaType, "/")
 	if len(parts) != 2 {
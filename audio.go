@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Audio-only uploads, such as podcasts, skip the video stages: there's
+// nothing to watermark, bucket by aspect ratio, package as a ladder or
+// storyboard. They're stored under an "audio" prefix rather than an aspect
+// ratio bucket.
+
+// normalizeAudio writes a faststart M4A of the first audio stream of
+// filePath and returns its path. AAC is copied, anything else re-encoded.
+// Cover art, which ffprobe lists as a video stream, is dropped.
+func (cfg *apiConfig) normalizeAudio(ctx context.Context, filePath string) (string, error) {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	audio, ok := probe.firstStream("audio")
+	if !ok {
+		return "", fmt.Errorf("%w: no audio stream", errPermanent)
+	}
+
+	args := []string{"-i", filePath, "-map", "0:a:0"}
+	copyAudio := audio.CodecName == "aac"
+	if copyAudio {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "192k")
+	}
+	log.Printf("normalize %s (%s): copy audio %t", filePath, probe.Format.FormatName, copyAudio)
+
+	output := filePath + ".processing"
+	args = append(args, "-movflags", "faststart", "-f", "mp4", output)
+	if err := cfg.transcoder.Transcode(ctx, args...); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// processAndStoreAudio is processAndStoreVideo for audio: normalize, store,
+// then build the waveform.
+func (cfg *apiConfig) processAndStoreAudio(ctx context.Context, video database.Video, rawPath string, progress *processingProgress) (database.Video, error) {
+	processedPath, err := cfg.normalizeAudio(progress.stage(ctx, stageNormalize), rawPath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("process audio: %w", err)
+	}
+	defer os.Remove(processedPath)
+
+	normalizedPath, loudness, err := cfg.runLoudnessStage(ctx, video, processedPath, progress)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("loudness: %w", err)
+	}
+	if normalizedPath != processedPath {
+		defer os.Remove(normalizedPath)
+		processedPath = normalizedPath
+	}
+
+	probe, err := cfg.prober.Probe(ctx, processedPath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("probe audio: %w", err)
+	}
+	duration := probe.duration()
+	progress.setDuration(duration)
+
+	prefix := videoKeyPrefix(database.MediaKindAudio, video.ID)
+	key := getRandomAssetPathWithPrefix("audio/mp4", prefix)
+	if err := cfg.uploadVideoFile(ctx, key, processedPath, "audio/mp4"); err != nil {
+		return database.Video{}, fmt.Errorf("upload audio: %w", err)
+	}
+	progress.publish(videoEventUploaded)
+
+	audioURL := cfg.objectReference(key)
+	video.VideoURL = &audioURL
+	video.MediaKind = database.MediaKindAudio
+	video.HLSURL = nil
+	video.DASHURL = nil
+	video.HLSStartPTS = nil
+	video.StoryboardVTTURL = nil
+
+	// Like storyboards, a failed waveform shouldn't fail the upload.
+	video.WaveformURL = nil
+	waveformKey, waveformPNG, err := cfg.runWaveformStage(progress.stage(ctx, stageWaveform), processedPath, prefix, duration)
+	if err != nil {
+		log.Printf("Couldn't build waveform for video %s: %v", video.ID, err)
+	} else {
+		waveformURL := cfg.objectReference(waveformKey)
+		video.WaveformURL = &waveformURL
+	}
+
+	video, err = cfg.saveProcessingOutputs(video)
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	cfg.storeVideoMetadata(ctx, video.ID, processedPath, loudness)
+	if waveformPNG != nil {
+		if err := cfg.storeGeneratedThumbnail(ctx, video.ID, waveformPNG, false); err != nil {
+			log.Printf("Couldn't store waveform thumbnail for video %s: %v", video.ID, err)
+		}
+	}
+	return video, nil
+}
+
+// runWaveformStage stores the waveform peaks of filePath at
+// prefix/waveform.json and returns its key along with the PNG rendering.
+func (cfg *apiConfig) runWaveformStage(ctx context.Context, filePath, prefix string, duration time.Duration) (string, []byte, error) {
+	waveform, err := cfg.generateWaveform(ctx, filePath, duration, cfg.processing.waveformPoints)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(waveform)
+	if err != nil {
+		return "", nil, err
+	}
+	key := prefix + "/" + waveformName
+	if err := cfg.objectStore.Put(ctx, key, bytes.NewReader(data), "application/json"); err != nil {
+		return "", nil, fmt.Errorf("put %s: %w", key, err)
+	}
+	image, err := renderWaveform(waveform, waveformImageWidth, waveformImageHeight)
+	if err != nil {
+		return "", nil, fmt.Errorf("render waveform: %w", err)
+	}
+	return key, image, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Subtitle tracks are accepted as SRT, WebVTT or SSA/ASS and always stored
+// as WebVTT, the one format browsers and HLS players read natively. Every
+// input is parsed into cues and re-rendered, so a stored track is known to
+// be well formed.
+
+const maxCaptionSize = 2 << 20
+
+var errInvalidCaptions = errors.New("invalid captions")
+
+type captionCue struct {
+	start, end time.Duration
+	// settings are WebVTT cue settings such as "line:0", kept from VTT
+	// input.
+	settings string
+	text     string
+}
+
+var (
+	captionTimingLine = regexp.MustCompile(`^(\S+)\s+-->\s+(\S+)(.*)$`)
+	ssaOverrideBlock  = regexp.MustCompile(`\{[^}]*\}`)
+	srtFontTag        = regexp.MustCompile(`(?i)</?font[^>]*>`)
+)
+
+// convertCaptions detects the format of data and returns it as WebVTT,
+// along with the end time of the last cue.
+func convertCaptions(data []byte) (string, time.Duration, error) {
+	if len(data) > maxCaptionSize {
+		return "", 0, fmt.Errorf("%w: file is larger than %d bytes", errInvalidCaptions, maxCaptionSize)
+	}
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	if !utf8.Valid(data) {
+		return "", 0, fmt.Errorf("%w: file isn't UTF-8", errInvalidCaptions)
+	}
+	text := strings.ReplaceAll(strings.ReplaceAll(string(data), "\r\n", "\n"), "\r", "\n")
+
+	var cues []captionCue
+	var err error
+	switch {
+	case strings.HasPrefix(text, "WEBVTT"):
+		cues, err = parseVTT(text)
+	case strings.Contains(text, "[Events]"):
+		cues, err = parseSSA(text)
+	default:
+		cues, err = parseSRT(text)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if len(cues) == 0 {
+		return "", 0, fmt.Errorf("%w: no cues found", errInvalidCaptions)
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].start < cues[j].start })
+
+	var end time.Duration
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "\n%s --> %s%s\n%s\n", vttTimestamp(cue.start), vttTimestamp(cue.end), cue.settings, cue.text)
+		end = max(end, cue.end)
+	}
+	return b.String(), end, nil
+}
+
+// captionBlocks splits text into blank-line separated blocks, each with the
+// line number it starts on.
+func captionBlocks(text string) ([][]string, []int) {
+	blocks := [][]string{}
+	starts := []int{}
+	var current []string
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if current != nil {
+				blocks = append(blocks, current)
+				current = nil
+			}
+			continue
+		}
+		if current == nil {
+			starts = append(starts, i+1)
+		}
+		current = append(current, line)
+	}
+	if current != nil {
+		blocks = append(blocks, current)
+	}
+	return blocks, starts
+}
+
+// parseCueTiming reads a "start --> end settings" line, with timestamps in
+// the given parser's format.
+func parseCueTiming(line string, parse func(string) (time.Duration, bool)) (captionCue, bool) {
+	m := captionTimingLine.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return captionCue{}, false
+	}
+	start, ok := parse(m[1])
+	if !ok {
+		return captionCue{}, false
+	}
+	end, ok := parse(m[2])
+	if !ok {
+		return captionCue{}, false
+	}
+	return captionCue{start: start, end: end, settings: strings.TrimRight(m[3], " \t")}, true
+}
+
+func parseVTT(text string) ([]captionCue, error) {
+	blocks, starts := captionBlocks(text)
+	cues := []captionCue{}
+	for i, block := range blocks[1:] {
+		line := starts[i+1]
+		first := strings.TrimSpace(block[0])
+		if strings.HasPrefix(first, "NOTE") || first == "STYLE" || first == "REGION" {
+			continue
+		}
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			// Optional cue identifier.
+			timing = 1
+		}
+		if timing >= len(block) {
+			return nil, fmt.Errorf("%w: line %d: cue has no timing", errInvalidCaptions, line)
+		}
+		cue, ok := parseCueTiming(block[timing], parseVTTTimestamp)
+		if !ok {
+			return nil, fmt.Errorf("%w: line %d: bad cue timing %q", errInvalidCaptions, line+timing, block[timing])
+		}
+		if err := finishCue(&cue, block[timing+1:], line); err != nil {
+			return nil, err
+		}
+		cues = append(cues, cue)
+	}
+	return cues, nil
+}
+
+func parseSRT(text string) ([]captionCue, error) {
+	blocks, starts := captionBlocks(text)
+	cues := []captionCue{}
+	for i, block := range blocks {
+		line := starts[i]
+		timing := 0
+		if _, err := strconv.Atoi(strings.TrimSpace(block[0])); err == nil {
+			timing = 1
+		}
+		if timing >= len(block) {
+			return nil, fmt.Errorf("%w: line %d: cue has no timing", errInvalidCaptions, line)
+		}
+		cue, ok := parseCueTiming(block[timing], parseSRTTimestamp)
+		if !ok {
+			return nil, fmt.Errorf("%w: line %d: not SRT, WebVTT or SSA", errInvalidCaptions, line+timing)
+		}
+		// SRT position tags and SSA overrides some tools leave in have no
+		// VTT equivalent; settings are VTT-only.
+		cue.settings = ""
+		body := []string{}
+		for _, l := range block[timing+1:] {
+			l = srtFontTag.ReplaceAllString(l, "")
+			body = append(body, ssaOverrideBlock.ReplaceAllString(l, ""))
+		}
+		if err := finishCue(&cue, body, line); err != nil {
+			return nil, err
+		}
+		cues = append(cues, cue)
+	}
+	return cues, nil
+}
+
+// parseSSA reads the Dialogue lines of an SSA/ASS [Events] section. Styling
+// and positioning overrides are dropped.
+func parseSSA(text string) ([]captionCue, error) {
+	cues := []captionCue{}
+	inEvents := false
+	fields := []string{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Format":
+			fields = fields[:0]
+			for _, f := range strings.Split(value, ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(f)))
+			}
+		case "Dialogue":
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("%w: line %d: Dialogue before Format", errInvalidCaptions, i+1)
+			}
+			// Text is always last and may itself contain commas.
+			values := strings.SplitN(value, ",", len(fields))
+			if len(values) != len(fields) {
+				return nil, fmt.Errorf("%w: line %d: Dialogue has %d fields, Format has %d", errInvalidCaptions, i+1, len(values), len(fields))
+			}
+			var cue captionCue
+			var startOK, endOK bool
+			var body string
+			for n, field := range fields {
+				switch field {
+				case "start":
+					cue.start, startOK = parseSSATimestamp(strings.TrimSpace(values[n]))
+				case "end":
+					cue.end, endOK = parseSSATimestamp(strings.TrimSpace(values[n]))
+				case "text":
+					body = values[n]
+				}
+			}
+			if !startOK || !endOK {
+				return nil, fmt.Errorf("%w: line %d: bad Dialogue timing", errInvalidCaptions, i+1)
+			}
+			body = ssaOverrideBlock.ReplaceAllString(body, "")
+			body = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(body)
+			if strings.TrimSpace(body) == "" {
+				// Drawing commands and effects leave nothing to show.
+				continue
+			}
+			if err := finishCue(&cue, strings.Split(body, "\n"), i+1); err != nil {
+				return nil, err
+			}
+			cues = append(cues, cue)
+		}
+	}
+	return cues, nil
+}
+
+// finishCue checks the cue's timing and sets its text from lines, which
+// mustn't be able to end the cue or start a new one early.
+func finishCue(cue *captionCue, lines []string, line int) error {
+	if cue.end <= cue.start {
+		return fmt.Errorf("%w: line %d: cue ends before it starts", errInvalidCaptions, line)
+	}
+	body := []string{}
+	for _, l := range lines {
+		l = strings.TrimSpace(strings.ReplaceAll(l, "-->", "->"))
+		if l != "" {
+			body = append(body, l)
+		}
+	}
+	if len(body) == 0 {
+		return fmt.Errorf("%w: line %d: cue has no text", errInvalidCaptions, line)
+	}
+	cue.text = strings.Join(body, "\n")
+	return nil
+}
+
+// parseVTTTimestamp reads [hh:]mm:ss.ttt.
+func parseVTTTimestamp(s string) (time.Duration, bool) {
+	return parseClock(s, ".", 3)
+}
+
+// parseSRTTimestamp reads hh:mm:ss,ttt. A dot is accepted too, since
+// plenty of files in the wild use one.
+func parseSRTTimestamp(s string) (time.Duration, bool) {
+	return parseClock(strings.Replace(s, ",", ".", 1), ".", 3)
+}
+
+// parseSSATimestamp reads h:mm:ss.cc.
+func parseSSATimestamp(s string) (time.Duration, bool) {
+	return parseClock(s, ".", 2)
+}
+
+// parseClock reads [h:]mm:ss<sep>fraction with exactly digits fraction
+// digits.
+func parseClock(s, sep string, digits int) (time.Duration, bool) {
+	clock, fraction, ok := strings.Cut(s, sep)
+	if !ok || len(fraction) != digits {
+		return 0, false
+	}
+	parts := strings.Split(clock, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var total time.Duration
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (i > 0 && (n > 59 || len(part) != 2)) {
+			return 0, false
+		}
+		total = total*60 + time.Duration(n)
+	}
+	frac, err := strconv.Atoi(fraction)
+	if err != nil || frac < 0 {
+		return 0, false
+	}
+	total *= time.Second
+	for i := digits; i < 9; i++ {
+		frac *= 10
+	}
+	return total + time.Duration(frac), true
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// A clip is a new video cut from an existing one. The handler creates the
+// clip's row straight away and a job does the cutting, then hands the
+// result to the same processing pipeline as an upload.
+
+const (
+	jobKindCreateClip = "create_clip"
+
+	clipCropPortrait = "portrait"
+)
+
+type createClipPayload struct {
+	SourceVideoID uuid.UUID `json:"source_video_id"`
+	Start         float64   `json:"start"`
+	End           float64   `json:"end"`
+	Crop          string    `json:"crop,omitempty"`
+}
+
+// handlerVideoClipCreate cuts [start, end) seconds out of one of the
+// caller's videos into a new video, also theirs. crop may be "portrait" to
+// centre-crop the clip to 9:16.
+func (cfg *apiConfig) handlerVideoClipCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start       *float64 `json:"start"`
+		End         *float64 `json:"end"`
+		Crop        string   `json:"crop"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+	}
+	type response struct {
+		Video database.Video `json:"video"`
+		Job   database.Job   `json:"job"`
+	}
+
+	sourceID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Start == nil || params.End == nil {
+		respondWithError(w, http.StatusBadRequest, "start and end are required", nil)
+		return
+	}
+	start, end := *params.Start, *params.End
+	if start < 0 || end <= start {
+		respondWithError(w, http.StatusBadRequest, "end must be after start, and start not negative", nil)
+		return
+	}
+	if maxLength := cfg.processing.clipMaxDuration; maxLength > 0 && end-start > maxLength.Seconds() {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Clips can be at most %s long", maxLength), nil)
+		return
+	}
+	if params.Crop != "" && params.Crop != clipCropPortrait {
+		respondWithError(w, http.StatusBadRequest, "crop must be portrait or empty", nil)
+		return
+	}
+
+	source, err := cfg.db.GetVideo(sourceID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return
+	}
+	if source.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if source.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not authorized to clip this video", nil)
+		return
+	}
+	if source.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video has no processed file yet", nil)
+		return
+	}
+	if source.MediaKind == database.MediaKindAudio && params.Crop != "" {
+		respondWithError(w, http.StatusBadRequest, "Audio can't be cropped", nil)
+		return
+	}
+	metadata, err := cfg.db.GetVideoMetadata(source.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	if metadata != nil && start >= metadata.DurationSeconds {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("start is past the end of the video (%.3fs)", metadata.DurationSeconds), nil)
+		return
+	}
+
+	title := params.Title
+	if title == "" {
+		title = source.Title + " (clip)"
+	}
+	description := params.Description
+	if description == "" {
+		description = source.Description
+	}
+	clip, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       title,
+		Description: description,
+		UserID:      userID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create clip", err)
+		return
+	}
+	clip.SourceVideoID = &source.ID
+	clip.MediaKind = source.MediaKind
+	if err := cfg.db.UpdateVideo(clip); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create clip", err)
+		return
+	}
+
+	job, err := cfg.jobs.enqueue(clip.ID, jobKindCreateClip, createClipPayload{
+		SourceVideoID: source.ID,
+		Start:         start,
+		End:           end,
+		Crop:          params.Crop,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue clip", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, response{Video: clip, Job: job})
+}
+
+// cutClip re-encodes [start, end) of input into a new file, cropped to 9:16
+// when asked. Audio-only input gives an audio-only clip. Re-encoding rather
+// than stream copying keeps the cut frame-accurate instead of snapping to
+// keyframes.
+func (cfg *apiConfig) cutClip(ctx context.Context, input string, start, end float64, crop string) (string, error) {
+	out, err := os.CreateTemp(cfg.admission.scratchDir, "tubely-clip*.mp4")
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+
+	args := []string{
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-i", input,
+		"-t", strconv.FormatFloat(end-start, 'f', 3, 64),
+		// Either map may come up empty: audio uploads have no video.
+		"-map", "0:v:0?",
+		"-map", "0:a:0?",
+	}
+	if crop == clipCropPortrait {
+		// Widest even 9:16 window that fits, centred.
+		args = append(args, "-vf", `crop=w=trunc(min(iw\,ih*9/16)/2)*2:h=trunc(min(ih\,iw*16/9)/2)*2`)
+	}
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-b:a", "128k",
+		"-movflags", "+faststart",
+		out.Name(),
+	)
+	if err := cfg.transcoder.Transcode(ctx, args...); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+func (cfg *apiConfig) runCreateClipJob(ctx context.Context, clipID uuid.UUID, payload createClipPayload) error {
+	clip, err := cfg.db.GetVideo(clipID)
+	if err != nil {
+		return err
+	}
+	if clip.ID == uuid.Nil {
+		return fmt.Errorf("%w: clip %s no longer exists", errPermanent, clipID)
+	}
+	source, err := cfg.db.GetVideo(payload.SourceVideoID)
+	if err != nil {
+		return err
+	}
+	key, err := videoObjectKey(source)
+	if err != nil {
+		return fmt.Errorf("%w: source video %s has no stored file", errPermanent, payload.SourceVideoID)
+	}
+	// Presigning doesn't check the object exists, and ffmpeg failing to
+	// open the URL would only be retried.
+	_, err = cfg.objectStore.Head(ctx, key)
+	if errors.Is(err, errObjectNotFound) {
+		return fmt.Errorf("%w: source video %s is missing", errPermanent, payload.SourceVideoID)
+	}
+	if err != nil {
+		return fmt.Errorf("head source: %w", err)
+	}
+	url, err := cfg.objectStore.PresignGet(ctx, key, time.Hour)
+	if err != nil {
+		return fmt.Errorf("presign source: %w", err)
+	}
+
+	progress := cfg.newProcessingProgress(clip)
+	progress.setDuration(time.Duration((payload.End - payload.Start) * float64(time.Second)))
+	clipPath, err := cfg.cutClip(progress.stage(ctx, stageCut), url, payload.Start, payload.End, payload.Crop)
+	if err != nil {
+		return fmt.Errorf("cut clip: %w", err)
+	}
+	defer os.Remove(clipPath)
+
+	previous := cfg.snapshotOutputs(ctx, clip)
+	clip, err = cfg.processAndStoreVideo(ctx, clip, clipPath, progress)
+	if err != nil {
+		return err
+	}
+	cfg.deleteStaleOutputs(ctx, previous, clip)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CMAF output packages the ladder once as fragmented MP4 and describes the
+// same init and media segments with both a DASH manifest.mpd and an HLS
+// master.m3u8, so serving both protocols doesn't double the storage.
+
+const (
+	cmafManifestName = "manifest.mpd"
+	cmafMasterName   = "master.m3u8"
+)
+
+// transcodeCMAF encodes the ladder for the video at filePath into outDir.
+// Video renditions share one adaptation set and audio is encoded once and
+// referenced by every HLS variant.
+func (cfg *apiConfig) transcodeCMAF(ctx context.Context, filePath, outDir string, ladder []hlsRendition, hasAudio bool) error {
+	args := ladderVideoArgs(filePath, ladder)
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		args = append(args, "-map", "a:0", "-c:a", "aac", "-b:a", "128k", "-ac", "2")
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-f", "dash",
+		"-seg_duration", "6",
+		"-use_template", "1",
+		"-use_timeline", "0",
+		"-dash_segment_type", "mp4",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-hls_playlist", "1",
+		"-hls_master_name", cmafMasterName,
+		filepath.Join(outDir, cmafManifestName),
+	)
+	return cfg.transcoder.Transcode(ctx, args...)
+}
+
+// runCMAFStage builds the ladder for the processed file and uploads it under
+// prefix/cmaf/. It returns the keys of the DASH manifest and the HLS master
+// playlist.
+func (cfg *apiConfig) runCMAFStage(ctx context.Context, filePath, prefix string) (mpdKey, m3u8Key string, err error) {
+	ladder, hasAudio, err := cfg.streamLadder(ctx, filePath)
+	if err != nil {
+		return "", "", err
+	}
+
+	outDir, err := os.MkdirTemp(cfg.admission.scratchDir, "tubely-cmaf")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(outDir)
+
+	if err := cfg.transcodeCMAF(ctx, filePath, outDir, ladder, hasAudio); err != nil {
+		return "", "", fmt.Errorf("transcode cmaf: %w", err)
+	}
+	if _, err := cfg.uploadDir(ctx, outDir, prefix+"/cmaf"); err != nil {
+		return "", "", err
+	}
+	return prefix + "/cmaf/" + cmafManifestName, prefix + "/cmaf/" + cmafMasterName, nil
+}
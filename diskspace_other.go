@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// freeDiskSpace can't tell on this platform, so free space checks pass.
+func freeDiskSpace(dir string) (free int64, ok bool, err error) {
+	return 0, false, nil
+}
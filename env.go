@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func getEnvInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", name, err)
+	}
+	return n
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s must be a duration: %v", name, err)
+	}
+	return d
+}
+
+func getEnvBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be a boolean: %v", name, err)
+	}
+	return b
+}
+
+func getEnvFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("%s must be a number: %v", name, err)
+	}
+	return f
+}
+
+// getEnvIntList parses a comma separated list such as "1080,720,480".
+func getEnvIntList(name string, fallback []int) []int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	list := []int{}
+	for _, part := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			log.Fatalf("%s must be a list of integers: %v", name, err)
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+// getEnvList parses a comma separated list of strings.
+func getEnvList(name string, fallback []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	list := []string{}
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
+
+// getEnvMap parses a comma separated list of key=value pairs such as
+// "square=sq,ultrawide=wide".
+func getEnvMap(name string) map[string]string {
+	m := map[string]string{}
+	value := os.Getenv(name)
+	if value == "" {
+		return m
+	}
+	for _, part := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || k == "" {
+			log.Fatalf("%s must be a list of key=value pairs, got %q", name, part)
+		}
+		m[k] = v
+	}
+	return m
+}
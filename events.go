@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Processing events are fanned out in-process to everyone watching a video,
+// so several tabs can follow the same upload. Nothing is persisted: a
+// watcher that connects late gets the last in-flight event, or a state
+// derived from the jobs table.
+
+const (
+	videoEventQueued   = "queued"
+	videoEventProgress = "progress"
+	videoEventUploaded = "uploaded"
+	videoEventReady    = "ready"
+	videoEventFailed   = "failed"
+
+	// videoEventBuffer is how many events a slow watcher may fall behind
+	// before the oldest are dropped.
+	videoEventBuffer = 16
+)
+
+type videoEvent struct {
+	Type       string    `json:"type"`
+	VideoID    uuid.UUID `json:"video_id"`
+	Stage      string    `json:"stage,omitempty"`
+	Percent    *float64  `json:"percent,omitempty"`
+	ETASeconds *float64  `json:"eta_seconds,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// terminal reports whether the event ends a processing run.
+func (e videoEvent) terminal() bool {
+	return e.Type == videoEventReady || e.Type == videoEventFailed
+}
+
+type videoEventHub struct {
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[chan videoEvent]struct{}
+	// latest is the most recent event of each video still being processed.
+	latest map[uuid.UUID]videoEvent
+}
+
+func newVideoEventHub() *videoEventHub {
+	return &videoEventHub{
+		subscribers: map[uuid.UUID]map[chan videoEvent]struct{}{},
+		latest:      map[uuid.UUID]videoEvent{},
+	}
+}
+
+// subscribe returns a channel of the video's events and a func that stops
+// them. latest is the video's last in-flight event, if it has one.
+func (h *videoEventHub) subscribe(videoID uuid.UUID) (events <-chan videoEvent, latest *videoEvent, unsubscribe func()) {
+	ch := make(chan videoEvent, videoEventBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[videoID] == nil {
+		h.subscribers[videoID] = map[chan videoEvent]struct{}{}
+	}
+	h.subscribers[videoID][ch] = struct{}{}
+	if event, ok := h.latest[videoID]; ok {
+		latest = &event
+	}
+	return ch, latest, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[videoID], ch)
+		if len(h.subscribers[videoID]) == 0 {
+			delete(h.subscribers, videoID)
+		}
+	}
+}
+
+// publish never blocks: a watcher whose buffer is full loses its oldest
+// event instead.
+func (h *videoEventHub) publish(event videoEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if event.terminal() {
+		delete(h.latest, event.VideoID)
+	} else {
+		h.latest[event.VideoID] = event
+	}
+	for ch := range h.subscribers[event.VideoID] {
+		select {
+		case ch <- event:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
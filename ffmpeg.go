@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ffprobeStream struct {
+	Index        int               `json:"index"`
+	CodecType    string            `json:"codec_type"`
+	CodecName    string            `json:"codec_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	PixFmt       string            `json:"pix_fmt"`
+	AvgFrameRate string            `json:"avg_frame_rate"`
+	RFrameRate   string            `json:"r_frame_rate"`
+	BitRate      string            `json:"bit_rate"`
+	Channels     int               `json:"channels"`
+	SampleRate   string            `json:"sample_rate"`
+	Tags         map[string]string `json:"tags"`
+	SideDataList []struct {
+		SideDataType string  `json:"side_data_type"`
+		Rotation     float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// rotation returns how many degrees clockwise the stream should be turned
+// for display, from the display matrix or the older rotate tag.
+func (s ffprobeStream) rotation() int {
+	degrees := 0
+	for _, sd := range s.SideDataList {
+		if sd.SideDataType == "Display Matrix" {
+			// The display matrix angle is counter-clockwise.
+			degrees = -int(math.Round(sd.Rotation))
+		}
+	}
+	if degrees == 0 {
+		degrees, _ = strconv.Atoi(s.Tags["rotate"])
+	}
+	return ((degrees % 360) + 360) % 360
+}
+
+// displayDimensions returns the width and height the stream is shown at,
+// swapping them for streams rotated a quarter turn.
+func (s ffprobeStream) displayDimensions() (int, int) {
+	if rotation := s.rotation(); rotation == 90 || rotation == 270 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+// frameRate parses ffprobe's "30000/1001" style rates.
+func (s ffprobeStream) frameRate() float64 {
+	for _, rate := range []string{s.AvgFrameRate, s.RFrameRate} {
+		num, den, ok := strings.Cut(rate, "/")
+		if !ok {
+			continue
+		}
+		n, err1 := strconv.ParseFloat(num, 64)
+		d, err2 := strconv.ParseFloat(den, 64)
+		if err1 == nil && err2 == nil && d != 0 && n != 0 {
+			return n / d
+		}
+	}
+	return 0
+}
+
+type ffprobeFormat struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+	StartTime  string `json:"start_time"`
+	Size       string `json:"size"`
+	BitRate    string `json:"bit_rate"`
+}
+
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  ffprobeFormat   `json:"format"`
+}
+
+// firstStream returns the first stream of the given codec type ("video",
+// "audio", ...). Streams[0] isn't necessarily the video.
+func (p ffprobeOutput) firstStream(codecType string) (ffprobeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == codecType {
+			return stream, true
+		}
+	}
+	return ffprobeStream{}, false
+}
+
+// duration is the container's duration, or 0 if ffprobe didn't report one.
+func (p ffprobeOutput) duration() time.Duration {
+	seconds, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// MediaProber reads container and stream information from a local path or
+// a URL.
+type MediaProber interface {
+	Probe(ctx context.Context, input string) (ffprobeOutput, error)
+}
+
+// Transcoder runs one ffmpeg invocation. args are everything after the
+// program name, inputs and outputs included.
+type Transcoder interface {
+	Transcode(ctx context.Context, args ...string) error
+}
+
+// transcodeProgress is ffmpeg's report of how far it has got through its
+// input.
+type transcodeProgress struct {
+	OutTime time.Duration
+	// Speed is the multiple of realtime ffmpeg is running at, 0 if unknown.
+	Speed float64
+	Done  bool
+}
+
+type transcodeProgressKey struct{}
+
+// withTranscodeProgress asks Transcode calls made with the returned context
+// to report progress to fn. Transcoders that can't are free to ignore it.
+func withTranscodeProgress(ctx context.Context, fn func(transcodeProgress)) context.Context {
+	return context.WithValue(ctx, transcodeProgressKey{}, fn)
+}
+
+func transcodeProgressFunc(ctx context.Context) func(transcodeProgress) {
+	fn, _ := ctx.Value(transcodeProgressKey{}).(func(transcodeProgress))
+	return fn
+}
+
+type transcodeLogKey struct{}
+
+// withTranscodeLog asks Transcode calls made with the returned context to
+// copy ffmpeg's log, its stderr, to w. Filters such as loudnorm report
+// their results there.
+func withTranscodeLog(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, transcodeLogKey{}, w)
+}
+
+func transcodeLogWriter(ctx context.Context) io.Writer {
+	w, _ := ctx.Value(transcodeLogKey{}).(io.Writer)
+	return w
+}
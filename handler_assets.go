@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chai2010/webp"
+	xdraw "golang.org/x/image/draw"
+)
+
+// GET /assets/{name} serves the file as is unless resize parameters are
+// given: ?w=320&h=180&fit=cover&format=webp. Derived variants are cached on
+// disk and, since asset names are random and never reused, marked
+// immutable.
+
+const assetVariantMaxAge = 365 * 24 * time.Hour
+
+type assetResizeConfig struct {
+	// widths and heights are the only sizes clients may request, so the
+	// cache can't be filled with arbitrary variants.
+	widths  []int
+	heights []int
+}
+
+type assetVariant struct {
+	width  int
+	height int
+	fit    string // contain, cover or fill
+	format string // jpeg, png or webp
+}
+
+var assetFormatContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+}
+
+func (cfg *apiConfig) handlerAsset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == "" || name != filepath.Base(name) || name[0] == '.' {
+		respondWithError(w, http.StatusNotFound, "Asset not found", nil)
+		return
+	}
+	diskPath := cfg.getAssetDiskPath(name)
+
+	query := r.URL.Query()
+	if !query.Has("w") && !query.Has("h") && !query.Has("fit") && !query.Has("format") {
+		w.Header().Set("Cache-Control", "no-store")
+		http.ServeFile(w, r, diskPath)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = assetSourceFormat(name)
+	}
+	variant, err := cfg.parseAssetVariant(query.Get("w"), query.Get("h"), query.Get("fit"), format)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	info, err := os.Stat(diskPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Asset not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read asset", err)
+		return
+	}
+
+	// The key covers the source's size and mtime so a rewritten file can't
+	// be served from a stale variant.
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%d|%s|%s",
+		name, info.Size(), info.ModTime().UnixNano(), variant.width, variant.height, variant.fit, variant.format)))
+	key := hex.EncodeToString(sum[:]) + "." + variant.format
+
+	data, err := cfg.cachedAssetVariant(key, diskPath, variant)
+	if errors.Is(err, errUnsupportedMedia) {
+		respondWithError(w, http.StatusUnsupportedMediaType, err.Error(), err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resize asset", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", assetFormatContentTypes[variant.format])
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(assetVariantMaxAge.Seconds())))
+	w.Header().Set("ETag", `"`+key+`"`)
+	http.ServeContent(w, r, key, info.ModTime(), bytes.NewReader(data))
+}
+
+// cachedAssetVariant returns the variant from the cache, rendering it first
+// if needed. Concurrent requests for the same key wait for one render.
+func (cfg *apiConfig) cachedAssetVariant(key, diskPath string, variant assetVariant) ([]byte, error) {
+	unlock := cfg.assetCacheLocks.Lock(key)
+	defer unlock()
+	if data, ok := cfg.assetCache.get(key); ok {
+		return data, nil
+	}
+	data, err := renderAssetVariant(diskPath, variant)
+	if err != nil {
+		return nil, err
+	}
+	return data, cfg.assetCache.put(key, data)
+}
+
+func (cfg *apiConfig) parseAssetVariant(width, height, fit, format string) (assetVariant, error) {
+	variant := assetVariant{fit: fit, format: format}
+	if width != "" {
+		n, err := strconv.Atoi(width)
+		if err != nil || !slices.Contains(cfg.assetResize.widths, n) {
+			return assetVariant{}, fmt.Errorf("w must be one of %v", cfg.assetResize.widths)
+		}
+		variant.width = n
+	}
+	if height != "" {
+		n, err := strconv.Atoi(height)
+		if err != nil || !slices.Contains(cfg.assetResize.heights, n) {
+			return assetVariant{}, fmt.Errorf("h must be one of %v", cfg.assetResize.heights)
+		}
+		variant.height = n
+	}
+	switch variant.fit {
+	case "":
+		variant.fit = "contain"
+	case "contain":
+	case "cover", "fill":
+		if variant.width == 0 || variant.height == 0 {
+			return assetVariant{}, fmt.Errorf("fit=%s needs both w and h", variant.fit)
+		}
+	default:
+		return assetVariant{}, fmt.Errorf("fit must be contain, cover or fill")
+	}
+	if _, ok := assetFormatContentTypes[variant.format]; !ok {
+		return assetVariant{}, fmt.Errorf("format must be jpeg, png or webp")
+	}
+	return variant, nil
+}
+
+// assetSourceFormat picks the output format when none was asked for: the
+// source's own, or JPEG for anything that isn't a supported output.
+func assetSourceFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		return "png"
+	case ".webp":
+		return "webp"
+	}
+	return "jpeg"
+}
+
+// renderAssetVariant decodes the image at path, resizes it and encodes it
+// in the variant's format.
+func renderAssetVariant(path string, variant assetVariant) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: asset isn't a supported image", errUnsupportedMedia)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("%w: asset is too large to resize", errUnsupportedMedia)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: asset can't be decoded", errUnsupportedMedia)
+	}
+
+	var src image.Image = img
+	if variant.format == "jpeg" {
+		src = flattenImage(img)
+	}
+	out := fitImage(src, variant.width, variant.height, variant.fit)
+
+	var buf bytes.Buffer
+	switch variant.format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	case "png":
+		err = png.Encode(&buf, out)
+	case "webp":
+		err = webp.Encode(&buf, out, &webp.Options{Quality: thumbnailWebPQuality})
+	}
+	return buf.Bytes(), err
+}
+
+// fitImage scales img towards width x height (either may be 0 to keep the
+// aspect ratio). contain fits inside the box, cover fills it and crops the
+// overflow from the centre, fill stretches. Images are never upscaled.
+func fitImage(img image.Image, width, height int, fit string) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	srcRect := b
+	var dw, dh int
+
+	switch fit {
+	case "fill":
+		dw, dh = min(width, sw), min(height, sh)
+	case "cover":
+		scale := max(float64(width)/float64(sw), float64(height)/float64(sh))
+		if scale > 1 {
+			// Too small to cover the box; crop to its aspect ratio instead,
+			// shrinking both sides by the same factor so the crop fits.
+			shrink := min(float64(sw)/float64(width), float64(sh)/float64(height), 1)
+			scale = 1
+			width = max(1, int(float64(width)*shrink))
+			height = max(1, int(float64(height)*shrink))
+		}
+		cw := int(float64(width) / scale)
+		ch := int(float64(height) / scale)
+		x0 := b.Min.X + (sw-cw)/2
+		y0 := b.Min.Y + (sh-ch)/2
+		srcRect = image.Rect(x0, y0, x0+cw, y0+ch)
+		dw, dh = width, height
+	default:
+		scale := 1.0
+		if width > 0 {
+			scale = min(scale, float64(width)/float64(sw))
+		}
+		if height > 0 {
+			scale = min(scale, float64(height)/float64(sh))
+		}
+		dw = max(1, int(float64(sw)*scale+0.5))
+		dh = max(1, int(float64(sh)*scale+0.5))
+	}
+
+	if srcRect == b && dw == sw && dh == sh {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, srcRect, xdraw.Src, nil)
+	return dst
+}
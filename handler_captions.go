@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Captions are stored as captions/<videoID>/<language>-<random>.vtt. A
+// replacement gets a new key so players holding a signed URL for the old
+// track never see it change underneath them.
+
+// captionLanguage accepts BCP 47 style tags such as "en", "pt-BR" or
+// "zh-Hant".
+var captionLanguage = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// maxCaptionLabelLength caps a track's label, in characters.
+const maxCaptionLabelLength = 64
+
+// validateCaptionLabel rejects labels that can't be written into an HLS
+// attribute: a newline would start a new playlist line.
+func validateCaptionLabel(label string) error {
+	if utf8.RuneCountInString(label) > maxCaptionLabelLength {
+		return fmt.Errorf("label must be at most %d characters", maxCaptionLabelLength)
+	}
+	if strings.ContainsFunc(label, unicode.IsControl) {
+		return errors.New("label must not contain control characters")
+	}
+	return nil
+}
+
+func captionsPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("captions/%s/", videoID)
+}
+
+// handlerCaptionsList returns a video's tracks with signed URLs.
+func (cfg *apiConfig) handlerCaptionsList(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	captions, err := cfg.db.GetCaptions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	for i := range captions {
+		captions[i].URL, err = cfg.urlSigner.SignURL(r.Context(), captions[i].Key, streamURLExpireTime)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign captions", err)
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, captions)
+}
+
+// handlerCaptionsCreate adds a track for a language the video doesn't have
+// yet. The multipart form carries the file as "captions", plus "language"
+// and an optional "label".
+func (cfg *apiConfig) handlerCaptionsCreate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.authorizeVideoUpload(w, r)
+	if !ok {
+		return
+	}
+
+	vtt, duration, ok := readCaptionUpload(w, r)
+	if !ok {
+		return
+	}
+	language := r.FormValue("language")
+	if !captionLanguage.MatchString(language) {
+		respondWithError(w, http.StatusBadRequest, "language must be a language tag such as en or pt-BR", nil)
+		return
+	}
+	existing, err := cfg.db.GetCaption(video.ID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if existing.ID != uuid.Nil {
+		respondWithError(w, http.StatusConflict, "Video already has captions in this language", nil)
+		return
+	}
+	label := strings.TrimSpace(r.FormValue("label"))
+	if label == "" {
+		label = language
+	}
+	if err := validateCaptionLabel(label); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	key, err := cfg.storeCaptions(r.Context(), video.ID, language, vtt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store captions", err)
+		return
+	}
+	caption, err := cfg.db.CreateCaption(database.CreateCaptionParams{
+		VideoID:         video.ID,
+		Language:        language,
+		Label:           label,
+		Key:             key,
+		DurationSeconds: duration.Seconds(),
+	})
+	if err != nil {
+		cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, key)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+	caption.URL, _ = cfg.urlSigner.SignURL(r.Context(), key, streamURLExpireTime)
+	respondWithJSON(w, http.StatusCreated, caption)
+}
+
+// handlerCaptionsReplace swaps the track for an existing language. The
+// label is kept unless a new one is given.
+func (cfg *apiConfig) handlerCaptionsReplace(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.authorizeVideoUpload(w, r)
+	if !ok {
+		return
+	}
+	caption, ok := cfg.getCaptionForRequest(w, r, video.ID)
+	if !ok {
+		return
+	}
+
+	vtt, duration, ok := readCaptionUpload(w, r)
+	if !ok {
+		return
+	}
+	label := strings.TrimSpace(r.FormValue("label"))
+	if err := validateCaptionLabel(label); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	key, err := cfg.storeCaptions(r.Context(), video.ID, caption.Language, vtt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store captions", err)
+		return
+	}
+
+	previousKey := caption.Key
+	caption.Key = key
+	caption.DurationSeconds = duration.Seconds()
+	if label != "" {
+		caption.Label = label
+	}
+	if err := cfg.db.UpdateCaption(caption); err != nil {
+		cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, key)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+	cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, previousKey)
+
+	caption, err = cfg.db.GetCaption(video.ID, caption.Language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	caption.URL, _ = cfg.urlSigner.SignURL(r.Context(), key, streamURLExpireTime)
+	respondWithJSON(w, http.StatusOK, caption)
+}
+
+func (cfg *apiConfig) handlerCaptionsDelete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.authorizeVideoUpload(w, r)
+	if !ok {
+		return
+	}
+	caption, ok := cfg.getCaptionForRequest(w, r, video.ID)
+	if !ok {
+		return
+	}
+
+	if err := cfg.db.DeleteCaption(caption.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete captions", err)
+		return
+	}
+	cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, caption.Key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) getCaptionForRequest(w http.ResponseWriter, r *http.Request, videoID uuid.UUID) (database.Caption, bool) {
+	caption, err := cfg.db.GetCaption(videoID, r.PathValue("language"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return database.Caption{}, false
+	}
+	if caption.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video has no captions in this language", nil)
+		return database.Caption{}, false
+	}
+	return caption, true
+}
+
+// readCaptionUpload parses the multipart form and converts its "captions"
+// file to WebVTT. It writes the error response itself.
+func readCaptionUpload(w http.ResponseWriter, r *http.Request) (string, time.Duration, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionSize+1<<20)
+	if err := r.ParseMultipartForm(maxCaptionSize); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+		return "", 0, false
+	}
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Missing captions file", err)
+		return "", 0, false
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxCaptionSize+1))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read captions", err)
+		return "", 0, false
+	}
+
+	vtt, duration, err := convertCaptions(data)
+	if errors.Is(err, errInvalidCaptions) {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return "", 0, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't convert captions", err)
+		return "", 0, false
+	}
+	return vtt, duration, true
+}
+
+func (cfg *apiConfig) storeCaptions(ctx context.Context, videoID uuid.UUID, language, vtt string) (string, error) {
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s%s-%s.vtt", captionsPrefix(videoID), language, base64.RawURLEncoding.EncodeToString(randBytes))
+	if err := cfg.objectStore.Put(ctx, key, strings.NewReader(vtt), "text/vtt"); err != nil {
+		return "", err
+	}
+	return key, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// localObjectStore is implemented by the stores whose presigned URLs point
+// back at this server rather than at a cloud provider.
+type localObjectStore interface {
+	ObjectStore
+	urlSigner() localURLSigner
+}
+
+func (cfg *apiConfig) handlerObjectGet(w http.ResponseWriter, r *http.Request) {
+	store, ok := cfg.objectStore.(localObjectStore)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Object store doesn't serve objects", nil)
+		return
+	}
+	key := r.PathValue("key")
+	if err := store.urlSigner().verify(http.MethodGet, key, r.URL.Query()); err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid signed URL", err)
+		return
+	}
+
+	body, info, err := store.Get(r.Context(), key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Object not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read object", err)
+		return
+	}
+	defer body.Close()
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	if rs, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, info.LastModified, rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	io.Copy(w, body)
+}
+
+func (cfg *apiConfig) handlerObjectPut(w http.ResponseWriter, r *http.Request) {
+	store, ok := cfg.objectStore.(localObjectStore)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Object store doesn't serve objects", nil)
+		return
+	}
+	key := r.PathValue("key")
+	if err := store.urlSigner().verify(http.MethodPut, key, r.URL.Query()); err != nil {
+		respondWithError(w, http.StatusForbidden, "Invalid signed URL", err)
+		return
+	}
+
+	err := store.Put(r.Context(), key, r.Body, r.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store object", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
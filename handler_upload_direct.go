@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Direct uploads let the browser send the video straight to the object
+// store. The API only hands out a presigned request for a key under
+// uploads/{videoID}/ and, once the client reports completion, queues the
+// object for processing.
+
+const (
+	maxDirectUploadSize    = 10 << 30 // 10GB
+	directUploadExpireTime = time.Hour
+)
+
+func directUploadPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("uploads/%s/", videoID)
+}
+
+func (cfg *apiConfig) handlerUploadVideoPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		Method      string `json:"method"`
+	}
+	type response struct {
+		Key       string            `json:"key"`
+		Method    string            `json:"method"`
+		URL       string            `json:"url"`
+		Headers   map[string]string `json:"headers,omitempty"`
+		Fields    map[string]string `json:"fields,omitempty"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, ok := cfg.authorizeVideoUpload(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid content type", err)
+		return
+	}
+	mediaType, ok = cfg.acceptMediaType(mediaType)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Not supported format", nil)
+		return
+	}
+
+	key := directUploadPrefix(video.ID) + uuid.NewString() + uploadMediaTypeToExt(mediaType)
+	resp := response{
+		Key:       key,
+		ExpiresAt: time.Now().UTC().Add(directUploadExpireTime),
+	}
+	switch strings.ToUpper(params.Method) {
+	case "", http.MethodPut:
+		url, err := cfg.objectStore.PresignPut(r.Context(), key, mediaType, directUploadExpireTime)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+			return
+		}
+		resp.Method = http.MethodPut
+		resp.URL = url
+		resp.Headers = map[string]string{"Content-Type": mediaType}
+	case http.MethodPost:
+		presigner, ok := cfg.objectStore.(postPresigner)
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, "Object store doesn't support POST uploads", nil)
+			return
+		}
+		post, err := presigner.PresignPost(r.Context(), key, mediaType, maxDirectUploadSize, directUploadExpireTime)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+			return
+		}
+		resp.Method = http.MethodPost
+		resp.URL = post.URL
+		resp.Fields = post.Fields
+	default:
+		respondWithError(w, http.StatusBadRequest, "Method must be PUT or POST", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerUploadVideoComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	video, ok := cfg.authorizeVideoUpload(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !strings.HasPrefix(params.Key, directUploadPrefix(video.ID)) || validateObjectKey(params.Key) != nil {
+		respondWithError(w, http.StatusBadRequest, "Key wasn't issued for this video", nil)
+		return
+	}
+
+	// A repeated complete gets the job the first one queued instead of a
+	// second run over the same upload, whose cleanup would delete the raw
+	// file from under the first.
+	unlock := cfg.directUploadLocks.Lock(params.Key)
+	defer unlock()
+	active, err := cfg.activeProcessingJob(video.ID, params.Key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing status", err)
+		return
+	}
+	if active.ID != uuid.Nil {
+		respondWithJSON(w, http.StatusAccepted, active)
+		return
+	}
+
+	info, err := cfg.objectStore.Head(r.Context(), params.Key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Uploaded object not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded object", err)
+		return
+	}
+	if info.Size <= 0 || info.Size > maxDirectUploadSize {
+		respondWithError(w, http.StatusBadRequest, "Uploaded object has an invalid size", nil)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(info.ContentType)
+	mediaType, ok = cfg.acceptMediaType(mediaType)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Uploaded object has an unsupported content type", nil)
+		return
+	}
+	if err := cfg.validateVideoObject(r.Context(), params.Key, mediaType); err != nil {
+		if errors.Is(err, errUnsupportedMedia) {
+			cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, params.Key)
+		}
+		respondWithValidationError(w, err)
+		return
+	}
+
+	job, err := cfg.jobs.enqueue(video.ID, jobKindProcessVideo, processVideoPayload{
+		RawKey:    params.Key,
+		MediaType: mediaType,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// activeProcessingJob returns the queued or running job processing rawKey,
+// or a zero Job if there is none.
+func (cfg *apiConfig) activeProcessingJob(videoID uuid.UUID, rawKey string) (database.Job, error) {
+	jobs, err := cfg.db.GetActiveJobs(videoID, jobKindProcessVideo)
+	if err != nil {
+		return database.Job{}, err
+	}
+	for _, job := range jobs {
+		var payload processVideoPayload
+		if json.Unmarshal([]byte(job.Payload), &payload) == nil && payload.RawKey == rawKey {
+			return job, nil
+		}
+	}
+	return database.Job{}, nil
+}
+
+// authorizeVideoUpload checks the caller owns the video in the path. It
+// writes the error response itself and reports whether to continue.
+func (cfg *apiConfig) authorizeVideoUpload(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// downloadObject copies key from the object store into a temp file and
+// returns its path. The caller is responsible for removing it.
+func (cfg *apiConfig) downloadObject(ctx context.Context, key string) (string, error) {
+	body, _, err := cfg.objectStore.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	tempFile, err := os.CreateTemp(cfg.admission.scratchDir, "tubely-download")
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+	if _, err := io.Copy(tempFile, body); err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
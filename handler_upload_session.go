@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the shape of the tus protocol: a session is
+// created with the total size, chunks are PATCHed with an Upload-Offset
+// header, HEAD reports how far the server got, and finalize hands the
+// assembled file to the regular processing pipeline.
+
+const (
+	maxUploadSessionSize = 10 << 30 // 10GB
+	uploadSessionTTL     = 24 * time.Hour
+)
+
+func (cfg *apiConfig) handlerUploadSessionCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+		Filename    string `json:"filename"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Size <= 0 || params.Size > maxUploadSessionSize {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload size", nil)
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid content type", err)
+		return
+	}
+	mediaType, ok := cfg.acceptMediaType(mediaType)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Not supported format", nil)
+		return
+	}
+	if !cfg.checkDiskSpace(w, cfg.uploadSessionsRoot, params.Size) {
+		return
+	}
+
+	partPath := filepath.Join(cfg.uploadSessionsRoot, uuid.NewString()+".part")
+	partFile, err := os.Create(partPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+	partFile.Close()
+
+	session, err := cfg.db.CreateUploadSession(database.CreateUploadSessionParams{
+		VideoID:     videoID,
+		UserID:      userID,
+		Size:        params.Size,
+		ContentType: mediaType,
+		Filename:    params.Filename,
+		Path:        partPath,
+		ExpiresAt:   time.Now().UTC().Add(uploadSessionTTL),
+	})
+	if err != nil {
+		os.Remove(partPath)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload session", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/video_upload/%s/sessions/%s", videoID, session.ID))
+	setUploadSessionHeaders(w, session)
+	respondWithJSON(w, http.StatusCreated, session)
+}
+
+func (cfg *apiConfig) handlerUploadSessionHead(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadSessionHeaders(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerUploadSessionPatch(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	unlock := cfg.uploadSessionLocks.Lock(session.ID.String())
+	defer unlock()
+
+	// Re-read under the lock; another PATCH may have just moved the offset.
+	session, err := cfg.db.GetUploadSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return
+	}
+	if session.CompletedAt != nil {
+		respondWithError(w, http.StatusConflict, "Upload session already finalized", nil)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Chunks must be application/offset+octet-stream", nil)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+	if offset != session.Offset {
+		setUploadSessionHeaders(w, session)
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the session offset", nil)
+		return
+	}
+	release, ok := cfg.acquireUploadSlot(w)
+	if !ok {
+		return
+	}
+	defer release()
+	if !cfg.checkDiskSpace(w, cfg.uploadSessionsRoot, r.ContentLength) {
+		return
+	}
+
+	partFile, err := os.OpenFile(session.Path, os.O_WRONLY, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+		return
+	}
+	defer partFile.Close()
+	// Drop anything written after the last recorded offset, e.g. a chunk that
+	// was interrupted by a crash before the database was updated.
+	if err := partFile.Truncate(offset); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset upload file", err)
+		return
+	}
+	if _, err := partFile.Seek(offset, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't seek upload file", err)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, session.Size-offset)
+	written, copyErr := io.Copy(partFile, body)
+	if err := partFile.Sync(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't flush upload file", err)
+		return
+	}
+	// Keep whatever arrived before a dropped connection so the client can
+	// resume from there.
+	session.Offset = offset + written
+	if err := cfg.db.UpdateUploadSessionOffset(session.ID, session.Offset); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update upload session", err)
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(copyErr, &maxBytesErr) {
+		setUploadSessionHeaders(w, session)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Chunk exceeds the declared upload size", copyErr)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("Upload session %s interrupted at offset %d: %v", session.ID, session.Offset, copyErr)
+	}
+
+	setUploadSessionHeaders(w, session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerUploadSessionFinalize(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	unlock := cfg.uploadSessionLocks.Lock(session.ID.String())
+	defer unlock()
+
+	session, err := cfg.db.GetUploadSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return
+	}
+	if session.CompletedAt != nil {
+		respondWithError(w, http.StatusConflict, "Upload session already finalized", nil)
+		return
+	}
+	if session.Offset != session.Size {
+		setUploadSessionHeaders(w, session)
+		respondWithError(w, http.StatusConflict, "Upload is not complete", nil)
+		return
+	}
+	release, ok := cfg.acquireUploadSlot(w)
+	if !ok {
+		return
+	}
+	defer release()
+	if err := cfg.validateVideoFile(r.Context(), session.Path, session.ContentType); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+
+	job, err := cfg.enqueueVideoProcessing(r.Context(), session.VideoID, session.Path, session.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+
+	if err := cfg.db.CompleteUploadSession(session.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't complete upload session", err)
+		return
+	}
+	os.Remove(session.Path)
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// authorizeUploadSession loads the session named in the path and checks it
+// belongs to the caller and the video in the path. It writes the error
+// response itself and reports whether the handler should continue.
+func (cfg *apiConfig) authorizeUploadSession(w http.ResponseWriter, r *http.Request) (database.UploadSession, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.UploadSession{}, false
+	}
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID", err)
+		return database.UploadSession{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.UploadSession{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.UploadSession{}, false
+	}
+
+	session, err := cfg.db.GetUploadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return database.UploadSession{}, false
+	}
+	if session.ID == uuid.Nil || session.VideoID != videoID {
+		respondWithError(w, http.StatusNotFound, "Upload session not found", nil)
+		return database.UploadSession{}, false
+	}
+	if session.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not authorized to use this upload session", nil)
+		return database.UploadSession{}, false
+	}
+	if session.CompletedAt == nil && time.Now().After(session.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload session expired", nil)
+		return database.UploadSession{}, false
+	}
+	return session, true
+}
+
+func setUploadSessionHeaders(w http.ResponseWriter, session database.UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+}
+
+// cleanupExpiredUploadSessions removes partial files for sessions that were
+// abandoned before being finalized.
+func (cfg *apiConfig) cleanupExpiredUploadSessions() {
+	sessions, err := cfg.db.GetExpiredUploadSessions(time.Now().UTC())
+	if err != nil {
+		log.Printf("Couldn't list expired upload sessions: %v", err)
+		return
+	}
+	for _, session := range sessions {
+		if err := os.Remove(session.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Couldn't remove upload file %s: %v", session.Path, err)
+			continue
+		}
+		if err := cfg.db.DeleteUploadSession(session.ID); err != nil {
+			log.Printf("Couldn't delete upload session %s: %v", session.ID, err)
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
-	"os"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -58,41 +60,44 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	switch mediaType {
-	case "image/jpeg":
-		break
-	case "image/png":
+	case "image/jpeg", "image/png", "image/webp", "image/gif":
 		break
 	default:
 		respondWithError(w, http.StatusBadRequest, "Non supported format", nil)
 		return
 	}
 
-	assetDiskPath := cfg.getAssetDiskPath(getAssetPath(mediaType))
-	fmt.Println("assetDiskPath: ", assetDiskPath)
-	dst, err := os.Create(assetDiskPath)
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "mediaFile failed to created", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
 		return
 	}
-	defer dst.Close()
-	if _, err = io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "copy data to file failed", err)
+
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+	if err := validateImage(file, mediaType); err != nil {
+		respondWithValidationError(w, err)
 		return
 	}
 
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", err)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "reading thumbnail failed", err)
+		return
+	}
+	assetURL, thumbnails, err := cfg.storeThumbnailImages(data)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't process thumbnail", err)
 		return
 	}
 
-	assetURL := cfg.getAssetURL(assetDiskPath)
+	previous := cfg.thumbnailAssetNames(video.ThumbnailURL, video.Thumbnails)
 	video.ThumbnailURL = &assetURL
+	video.Thumbnails = thumbnails
+	video.ThumbnailGenerated = false
 	fmt.Println("assetURL: ", assetURL)
 
 	err = cfg.db.UpdateVideo(video)
@@ -100,6 +105,67 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusInternalServerError, "Get video from database failed", err)
 		return
 	}
+	for _, name := range previous {
+		cfg.scheduleDeletion(r.Context(), database.DeletionKindAsset, name)
+	}
 
 	respondWithJSON(w, http.StatusOK, video)
 }
+
+// handlerThumbnailRegenerate queues a job that extracts a new thumbnail from
+// the stored video, either at "timestamp" seconds or with the given mode.
+// It replaces whatever thumbnail the video has, including an uploaded one.
+func (cfg *apiConfig) handlerThumbnailRegenerate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Mode      string   `json:"mode"`
+		Timestamp *float64 `json:"timestamp"`
+	}
+
+	video, ok := cfg.authorizeVideoUpload(w, r)
+	if !ok {
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file", nil)
+		return
+	}
+	if video.MediaKind == database.MediaKindAudio {
+		respondWithError(w, http.StatusBadRequest, "Audio has no frames to take a thumbnail from", nil)
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	payload := generateThumbnailPayload{Mode: params.Mode, Timestamp: params.Timestamp}
+	switch {
+	case params.Timestamp != nil:
+		if *params.Timestamp < 0 {
+			respondWithError(w, http.StatusBadRequest, "Timestamp must not be negative", nil)
+			return
+		}
+		payload.Mode = thumbnailModeTimestamp
+	case params.Mode == thumbnailModeScene:
+	case params.Mode == "":
+		payload.Mode = cfg.processing.thumbnail.mode
+		if payload.Mode == thumbnailModeTimestamp {
+			seconds := cfg.processing.thumbnail.at.Seconds()
+			payload.Timestamp = &seconds
+		}
+	default:
+		respondWithError(w, http.StatusBadRequest, "Mode must be timestamp or scene", nil)
+		return
+	}
+
+	job, err := cfg.jobs.enqueue(video.ID, jobKindGenerateThumbnail, payload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue thumbnail generation", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
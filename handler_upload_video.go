@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 
@@ -37,20 +39,32 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
 	}
 	if video.UserID != userID {
 		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", err)
 		return
 	}
 
-	videoSrc, header, err := r.FormFile("video")
+	release, ok := cfg.acquireUploadSlot(w)
+	if !ok {
+		return
+	}
+	defer release()
+	if !cfg.checkDiskSpace(w, cfg.admission.scratchDir, r.ContentLength) {
+		return
+	}
+
+	// Read the part straight into the scratch directory; FormFile would
+	// spool it to the OS temp dir first.
+	videoSrc, err := multipartFile(r, "video")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Getting video failed", err)
+		respondWithError(w, http.StatusBadRequest, "Getting video failed", err)
 		return
 	}
 	defer videoSrc.Close()
 
-	mediaType := header.Header.Get("Content-Type")
+	mediaType := videoSrc.Header.Get("Content-Type")
 	if mediaType == "" {
 		respondWithError(w, http.StatusBadRequest, "Missing Content-Type for video", nil)
 		return
@@ -58,20 +72,20 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	mediaType, _, err = mime.ParseMediaType(mediaType)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "failed to parse media type", err)
+		return
 	}
-	switch mediaType {
-	case "video/mp4":
-		break
-	default:
+	mediaType, ok = cfg.acceptMediaType(mediaType)
+	if !ok {
 		respondWithError(w, http.StatusBadRequest, "Not supported format", nil)
 		return
 	}
 
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	tempFile, err := os.CreateTemp(cfg.admission.scratchDir, "tubely-upload*"+uploadMediaTypeToExt(mediaType))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "created tempFile failed", nil)
 		return
 	}
+	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
 	if _, err = io.Copy(tempFile, videoSrc); err != nil {
@@ -83,41 +97,63 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "failed to reset video file ", err)
 		return
 	}
-	processedVideoPath, err := processVideoForStart(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "created processVideo failed", err)
-
+	if err := cfg.validateVideoFile(r.Context(), tempFile.Name(), mediaType); err != nil {
+		respondWithValidationError(w, err)
+		return
 	}
-	os.Remove(tempFile.Name())
-	defer os.Remove(processedVideoPath)
-	ratio, err := getVideoAspectRatio(processedVideoPath)
+	job, err := cfg.enqueueVideoProcessing(r.Context(), video.ID, tempFile.Name(), mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "failed to get vidoe ratio ", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
 		return
 	}
 
-	key := getAssetPathWithPrefix(header.Filename, ratio)
-	videoFile, err := os.Open(processedVideoPath)
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// multipartFile returns the first part of r's multipart body named name,
+// positioned to be read as it streams in.
+func multipartFile(r *http.Request, name string) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "failed to open vidoe file", err)
-		return
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %q part in form", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == name {
+			return part, nil
+		}
+		part.Close()
 	}
-	defer videoFile.Close()
+}
 
-	videoURL := fmt.Sprintf("%s,%s", cfg.s3Bucket, key)
-	fmt.Println("upload VideoURl: ", videoURL)
-	video.VideoURL = &videoURL
-	err = cfg.db.UpdateVideo(video)
+// uploadVideoFile puts the file at path into the object store and checks
+// that the object is actually there before the caller records the key.
+func (cfg *apiConfig) uploadVideoFile(ctx context.Context, key, path, contentType string) error {
+	videoFile, err := os.Open(path)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Get video from database failed", err)
-		return
+		return err
 	}
-
-	signedVideo, err := cfg.dbVideoToSignedVideo(video)
+	defer videoFile.Close()
+	stat, err := videoFile.Stat()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Signed video failed", err)
-		return
+		return err
 	}
 
-	respondWithJSON(w, http.StatusOK, signedVideo)
+	if err := cfg.objectStore.Put(ctx, key, videoFile, contentType); err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	info, err := cfg.objectStore.Head(ctx, key)
+	if err != nil {
+		return fmt.Errorf("head %s: %w", key, err)
+	}
+	if info.Size != stat.Size() {
+		return fmt.Errorf("uploaded %s is %d bytes, expected %d", key, info.Size, stat.Size())
+	}
+	return nil
 }
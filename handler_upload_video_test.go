@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// newTestConfig wires an apiConfig to a fresh database, the memory object
+// store and media.
+func newTestConfig(t *testing.T, media *fakeMediaTools) *apiConfig {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	aspectRatio, err := newAspectRatioConfig(0.02, nil)
+	if err != nil {
+		t.Fatalf("newAspectRatioConfig: %v", err)
+	}
+	store := newMemoryObjectStore(localURLSigner{baseURL: "http://localhost:8091", secret: []byte(testJWTSecret)})
+	events := newVideoEventHub()
+	return &apiConfig{
+		db:                 db,
+		jwtSecret:          testJWTSecret,
+		assetsRoot:         t.TempDir(),
+		objectStore:        store,
+		urlSigner:          storeURLSigner{store: store},
+		uploadSessionsRoot: t.TempDir(),
+		uploadSessionLocks: newKeyedMutex(),
+		directUploadLocks:  newKeyedMutex(),
+		prober:             media,
+		transcoder:         media,
+		jobs:               newJobQueue(db, 0, events),
+		events:             events,
+		processing: processingConfig{
+			thumbnail:   thumbnailOptions{mode: thumbnailModeTimestamp},
+			aspectRatio: aspectRatio,
+			videoTypes:  []string{"video/mp4"},
+		},
+		admission: admissionConfig{
+			scratchDir:  t.TempDir(),
+			uploadSlots: make(chan struct{}, 1),
+			retryAfter:  time.Second,
+		},
+		assetCacheLocks: newKeyedMutex(),
+	}
+}
+
+// createTestVideo creates a user and a video they own, returning the video
+// and a token for the user.
+func createTestVideo(t *testing.T, cfg *apiConfig) (database.Video, string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "password",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:  "Test video",
+		UserID: user.ID,
+	})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	return video, token
+}
+
+// uploadTestVideo posts a small MP4-looking file to the upload handler.
+func uploadTestVideo(t *testing.T, cfg *apiConfig, videoID uuid.UUID, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="test.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatalf("CreatePart: %v", err)
+	}
+	part.Write([]byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2avc1mp41"))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.SetPathValue("videoID", videoID.String())
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, r)
+	return w
+}
+
+// processingStatus fetches the video's processing job through the handler.
+func processingStatus(t *testing.T, cfg *apiConfig, videoID uuid.UUID) database.Job {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+videoID.String()+"/processing", nil)
+	r.SetPathValue("videoID", videoID.String())
+	w := httptest.NewRecorder()
+	cfg.handlerVideoProcessingStatus(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("processing status: got %d: %s", w.Code, w.Body)
+	}
+	var job database.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatalf("decode job: %v", err)
+	}
+	return job
+}
+
+// lastEvent returns the most recent event buffered on ch.
+func lastEvent(t *testing.T, ch <-chan videoEvent) videoEvent {
+	t.Helper()
+	var event videoEvent
+	for {
+		select {
+		case event = <-ch:
+		default:
+			if event.Type == "" {
+				t.Fatal("no event published")
+			}
+			return event
+		}
+	}
+}
+
+func TestUploadVideoProcessing(t *testing.T) {
+	media := newFakeMediaTools()
+	cfg := newTestConfig(t, media)
+	video, token := createTestVideo(t, cfg)
+
+	w := uploadTestVideo(t, cfg, video.ID, token)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: got %d: %s", w.Code, w.Body)
+	}
+	if job := processingStatus(t, cfg, video.ID); job.Status != database.JobStatusQueued {
+		t.Fatalf("status before processing = %q, want %q", job.Status, database.JobStatusQueued)
+	}
+
+	events, _, unsubscribe := cfg.events.subscribe(video.ID)
+	defer unsubscribe()
+	if !cfg.runNextJob() {
+		t.Fatal("runNextJob found no job")
+	}
+
+	job := processingStatus(t, cfg, video.ID)
+	if job.Status != database.JobStatusSucceeded {
+		t.Fatalf("status = %q (error %v), want %q", job.Status, job.Error, database.JobStatusSucceeded)
+	}
+	if event := lastEvent(t, events); event.Type != videoEventReady {
+		t.Errorf("last event = %q, want %q", event.Type, videoEventReady)
+	}
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.VideoURL == nil || !strings.Contains(*video.VideoURL, "landscape/"+video.ID.String()+"/") {
+		t.Errorf("video URL = %v, want a landscape key", video.VideoURL)
+	}
+	if !slices.ContainsFunc(media.transcodeCalls(), func(args []string) bool {
+		return slices.Contains(args, "0:v:0") && slices.Contains(args, "faststart")
+	}) {
+		t.Error("video was never normalized")
+	}
+}
+
+func TestUploadVideoRejectsUnprobeableFile(t *testing.T) {
+	media := newFakeMediaTools()
+	media.probeErr = errors.New("invalid data found when processing input")
+	cfg := newTestConfig(t, media)
+	video, token := createTestVideo(t, cfg)
+
+	w := uploadTestVideo(t, cfg, video.ID, token)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("upload: got %d: %s, want %d", w.Code, w.Body, http.StatusUnsupportedMediaType)
+	}
+	job, err := cfg.latestVideoJob(video.ID)
+	if err != nil {
+		t.Fatalf("latestVideoJob: %v", err)
+	}
+	if job.ID != uuid.Nil {
+		t.Errorf("rejected upload queued job %s", job.ID)
+	}
+}
+
+func TestUploadVideoTranscodeFailure(t *testing.T) {
+	media := newFakeMediaTools()
+	cfg := newTestConfig(t, media)
+	video, token := createTestVideo(t, cfg)
+
+	w := uploadTestVideo(t, cfg, video.ID, token)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: got %d: %s", w.Code, w.Body)
+	}
+
+	media.mu.Lock()
+	media.transcodeErr = fmt.Errorf("%w: ffmpeg exited with status 1", errPermanent)
+	media.mu.Unlock()
+	events, _, unsubscribe := cfg.events.subscribe(video.ID)
+	defer unsubscribe()
+	if !cfg.runNextJob() {
+		t.Fatal("runNextJob found no job")
+	}
+
+	job := processingStatus(t, cfg, video.ID)
+	if job.Status != database.JobStatusFailed {
+		t.Fatalf("status = %q, want %q", job.Status, database.JobStatusFailed)
+	}
+	if job.Error == nil || !strings.Contains(*job.Error, "ffmpeg exited") {
+		t.Errorf("job error = %v, want the transcode error", job.Error)
+	}
+	if event := lastEvent(t, events); event.Type != videoEventFailed {
+		t.Errorf("last event = %q, want %q", event.Type, videoEventFailed)
+	}
+}
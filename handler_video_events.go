@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// sseHeartbeatInterval keeps idle streams from being cut by proxies.
+const sseHeartbeatInterval = 15 * time.Second
+
+// handlerVideoEvents streams a video's processing events as Server-Sent
+// Events. Like the /processing status it replaces, it needs no token:
+// EventSource can't send an Authorization header. The stream opens with the
+// video's current state and stays open until the client goes away.
+func (cfg *apiConfig) handlerVideoEvents(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported", nil)
+		return
+	}
+
+	// Subscribe before reading the jobs table so nothing published in
+	// between is missed.
+	events, latest, unsubscribe := cfg.events.subscribe(videoID)
+	defer unsubscribe()
+	if latest == nil {
+		latest, err = cfg.currentVideoEvent(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get processing status", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if latest != nil {
+		if err := writeSSE(w, *latest); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// currentVideoEvent derives a video's state from its latest processing or
+// clip job, for watchers that connect while nothing is in flight. It
+// returns nil for a video that has never been queued.
+func (cfg *apiConfig) currentVideoEvent(video database.Video) (*videoEvent, error) {
+	latest, err := cfg.latestVideoJob(video.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	event := videoEvent{VideoID: video.ID, At: time.Now().UTC()}
+	switch latest.Status {
+	case database.JobStatusQueued:
+		event.Type = videoEventQueued
+	case database.JobStatusRunning:
+		event.Type = videoEventProgress
+	case database.JobStatusSucceeded:
+		event.Type = videoEventReady
+	case database.JobStatusFailed:
+		event.Type = videoEventFailed
+	default:
+		// Videos uploaded before processing moved to jobs.
+		if video.VideoURL == nil {
+			return nil, nil
+		}
+		event.Type = videoEventReady
+	}
+	if latest.Error != nil && event.Type != videoEventReady {
+		event.Error = *latest.Error
+	}
+	return &event, nil
+}
+
+func writeSSE(w http.ResponseWriter, event videoEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
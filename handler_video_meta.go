@@ -4,14 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math"
+	"log"
 	"net/http"
-	"os/exec"
+	"path"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
@@ -85,6 +83,12 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	// The row is gone, so anything we fail to queue here is picked up by the
+	// orphan sweeper later.
+	err = cfg.deleteVideoStorage(r.Context(), video)
+	if err != nil {
+		log.Printf("Couldn't queue storage deletion for video %s: %v", video.ID, err)
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -102,6 +106,11 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	video.Metadata, err = cfg.db.GetVideoMetadata(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
 	signedVideo, err := cfg.dbVideoToSignedVideo(video)
 	if err != nil {
 		respondWithJSON(w, http.StatusOK, video)
@@ -128,8 +137,16 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	metadata, err := cfg.db.GetVideoMetadataForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve video metadata", err)
+		return
+	}
 	signedVideos := make([]database.Video, len(videos))
 	for i, video := range videos {
+		if m, ok := metadata[video.ID]; ok {
+			video.Metadata = &m
+		}
 		signedVideos[i], err = cfg.dbVideoToSignedVideo(video)
 		if err != nil {
 			fmt.Println("VideosRetrieve can't generate signed video url using ", video.VideoURL)
@@ -140,88 +157,92 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 	respondWithJSON(w, http.StatusOK, signedVideos)
 }
 
-func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
-	if video.VideoURL == nil {
-		return database.Video{}, fmt.Errorf("VideoUrl Invalid with null ")
-	}
-	videoUrls := strings.Split(*video.VideoURL, ",")
-	if len(videoUrls) != 2 {
-		return database.Video{}, fmt.Errorf("VideoUrl Invalid with value")
-	}
-	bucket := videoUrls[0]
-	key := videoUrls[1]
-	videoURL, err := generatePresignedURL(cfg.s3Client, bucket, key, time.Hour*24)
+// handlerVideoCookies sets CloudFront signed cookies covering every object
+// under the video's key prefix, for players that fetch many files per video.
+func (cfg *apiConfig) handlerVideoCookies(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
 	if err != nil {
-		return database.Video{}, err
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
 	}
-	video.VideoURL = &videoURL
-	return video, nil
-}
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	type VideoMetadata struct {
-		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-		} `json:"streams"`
+	signer, ok := cfg.urlSigner.(cookieSigner)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Signed cookies aren't enabled", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
 	}
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	fmt.Println("path: ", filePath)
-	output, err := cmd.Output()
+	key, err := videoObjectKey(video)
 	if err != nil {
-		return "", err
+		respondWithError(w, http.StatusNotFound, "Video has no stored object", err)
+		return
 	}
-	var videoMetadata VideoMetadata
-	err = json.Unmarshal(output, &videoMetadata)
+
+	cookies, err := signer.SignCookies(path.Dir(key), time.Hour*24)
 	if err != nil {
-		return "", err
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign cookies", err)
+		return
 	}
-	if len(videoMetadata.Streams) == 0 {
-		return "", fmt.Errorf("Stream data is empty")
+	for _, cookie := range cookies {
+		http.SetCookie(w, cookie)
 	}
-	width := videoMetadata.Streams[0].Width
-	height := videoMetadata.Streams[0].Height
-	return getRatioName(width, height), nil
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func getRatioName(width, height int) string {
-	ratio := float64(width) / float64(height)
-
-	// Round to 3 decimal places for comparison
-	rounded := math.Round(ratio*1000) / 1000
-	fmt.Println("round: ", rounded)
+// videoObjectKey extracts the object key from the "bucket,key" value stored
+// in video_url.
+func videoObjectKey(video database.Video) (string, error) {
+	return objectKeyFromReference(video.VideoURL)
+}
 
-	switch rounded {
-	case 1.778: // 16:9
-		return "landscape"
-	case 0.563: // 9:16 (vertical video)
-		return "portrait"
-	default:
-		return "other"
+func objectKeyFromReference(ref *string) (string, error) {
+	if ref == nil {
+		return "", fmt.Errorf("object reference is null")
+	}
+	parts := strings.Split(*ref, ",")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid object reference %q", *ref)
 	}
+	return parts[1], nil
 }
 
-func processVideoForStart(filePath string) (string, error) {
-	output := filePath + ".processing"
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", output)
-	_, err := cmd.Output()
+func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
+	key, err := videoObjectKey(video)
 	if err != nil {
-		return "", err
+		return database.Video{}, err
 	}
-	return output, nil
-
-}
-
-func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
-	client := s3.NewPresignClient(s3Client)
-	presignGetObject, err := client.PresignGetObject(context.Background(),
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		},
-		s3.WithPresignExpires(expireTime))
+	videoURL, err := cfg.urlSigner.SignURL(context.Background(), key, time.Hour*24)
 	if err != nil {
-		return "", err
+		return database.Video{}, err
+	}
+	video.VideoURL = &videoURL
+	if video.HLSURL != nil {
+		hlsURL := cfg.getVideoStreamURL(video.ID, "hls", "master.m3u8")
+		video.HLSURL = &hlsURL
+	}
+	if video.DASHURL != nil {
+		dashURL := cfg.getVideoStreamURL(video.ID, "dash", cmafManifestName)
+		video.DASHURL = &dashURL
+	}
+	if video.StoryboardVTTURL != nil {
+		vttURL := cfg.getVideoStreamURL(video.ID, "storyboard", storyboardVTTName)
+		video.StoryboardVTTURL = &vttURL
 	}
-	return presignGetObject.URL, nil
+	if video.WaveformURL != nil {
+		waveformKey, err := videoObjectKey(database.Video{VideoURL: video.WaveformURL})
+		if err != nil {
+			return database.Video{}, err
+		}
+		waveformURL, err := cfg.urlSigner.SignURL(context.Background(), waveformKey, time.Hour*24)
+		if err != nil {
+			return database.Video{}, err
+		}
+		video.WaveformURL = &waveformURL
+	}
+	return video, nil
 }
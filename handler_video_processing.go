@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoProcessingStatus(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	job, err := cfg.latestVideoJob(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing status", err)
+		return
+	}
+	if job.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video has no processing job", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, job)
+}
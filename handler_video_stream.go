@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// HLS playlists reference segments by relative path, which a presigned URL
+// can't cover. handlerVideoHLSPlaylist serves each playlist through the API
+// and rewrites every URI in it: nested playlists point back here and media
+// files get their own signed URL.
+
+const streamURLExpireTime = time.Hour * 24
+
+var playlistURIAttr = regexp.MustCompile(`URI="([^"]*)"`)
+
+const (
+	// subtitlePlaylistDir holds the generated caption playlists, which
+	// aren't stored objects.
+	subtitlePlaylistDir = "subtitles/"
+	subtitleGroupID     = "subs"
+)
+
+func (cfg *apiConfig) handlerVideoHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	masterKey, err := objectKeyFromReference(video.HLSURL)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Video has no HLS stream", err)
+		return
+	}
+
+	if name, ok := strings.CutPrefix(r.PathValue("path"), subtitlePlaylistDir); ok {
+		if language, ok := strings.CutSuffix(name, ".vtt"); ok {
+			cfg.serveSubtitleSegment(w, r, video, language)
+			return
+		}
+		cfg.serveSubtitlePlaylist(w, r, video.ID, strings.TrimSuffix(name, ".m3u8"))
+		return
+	}
+
+	baseDir := path.Dir(masterKey)
+	key, ok := streamObjectKey(baseDir, r.PathValue("path"))
+	if !ok || path.Ext(key) != ".m3u8" {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+
+	body, _, err := cfg.objectStore.Get(r.Context(), key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read playlist", err)
+		return
+	}
+	defer body.Close()
+	playlist, err := io.ReadAll(body)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read playlist", err)
+		return
+	}
+
+	rewritten, err := rewritePlaylist(string(playlist), func(uri string) (string, error) {
+		return cfg.resolveStreamURI(r.Context(), video.ID, "hls", baseDir, path.Dir(key), uri)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign playlist", err)
+		return
+	}
+	if key == masterKey {
+		captions, err := cfg.db.GetCaptions(video.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+			return
+		}
+		rewritten = addSubtitleRenditions(rewritten, captions, func(language string) string {
+			return cfg.getVideoStreamURL(video.ID, "hls", subtitlePlaylistDir+language+".m3u8")
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, rewritten)
+}
+
+// serveSubtitlePlaylist serves a one-segment media playlist for a caption
+// track. Tracks are stored whole, so the segment is the whole track, served
+// by serveSubtitleSegment.
+func (cfg *apiConfig) serveSubtitlePlaylist(w http.ResponseWriter, r *http.Request, videoID uuid.UUID, language string) {
+	caption, err := cfg.db.GetCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if caption.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+	url := cfg.getVideoStreamURL(videoID, "hls", subtitlePlaylistDir+language+".vtt")
+
+	// The segment has to span the whole video or players stop asking for
+	// cues after the last one.
+	duration := caption.DurationSeconds
+	metadata, err := cfg.db.GetVideoMetadata(videoID)
+	if err == nil && metadata != nil {
+		duration = max(duration, metadata.DurationSeconds)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+		int(math.Ceil(duration)), duration, url)
+}
+
+// serveSubtitleSegment serves a caption track with the X-TIMESTAMP-MAP
+// header that lines its cues up with the ladder's MPEG-TS timestamps.
+// Without it Safari treats the cues as starting at PTS zero and they drift
+// by however late the muxer started.
+func (cfg *apiConfig) serveSubtitleSegment(w http.ResponseWriter, r *http.Request, video database.Video, language string) {
+	caption, err := cfg.db.GetCaption(video.ID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if caption.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Captions not found", nil)
+		return
+	}
+	body, _, err := cfg.objectStore.Get(r.Context(), caption.Key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Captions not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read captions", err)
+		return
+	}
+	defer body.Close()
+	vtt, err := io.ReadAll(body)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read captions", err)
+		return
+	}
+
+	track := string(vtt)
+	if video.HLSStartPTS != nil {
+		track = withTimestampMap(track, *video.HLSStartPTS)
+	}
+	w.Header().Set("Content-Type", "text/vtt")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, track)
+}
+
+// withTimestampMap sets the X-TIMESTAMP-MAP header, mapping the track's
+// zero to startPTS. One the uploader wrote is replaced, since it can't know
+// where our ladder starts.
+func withTimestampMap(vtt string, startPTS int64) string {
+	vtt = strings.ReplaceAll(vtt, "\r\n", "\n")
+	header, cues, _ := strings.Cut(vtt, "\n\n")
+	lines := strings.Split(header, "\n")
+	out := []string{lines[0], fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000", startPTS)}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "X-TIMESTAMP-MAP=") {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "\n") + "\n\n" + cues
+}
+
+// hlsAttributeValue makes s safe inside a quoted playlist attribute. Labels
+// are validated on upload; this covers tracks saved before that.
+func hlsAttributeValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '"':
+			return '\''
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// addSubtitleRenditions declares each caption track in a master playlist
+// as an EXT-X-MEDIA subtitle rendition and points every variant at the
+// group.
+func addSubtitleRenditions(master string, captions []database.Caption, playlistURL func(language string) string) string {
+	if len(captions) == 0 {
+		return master
+	}
+	media := []string{}
+	for _, caption := range captions {
+		media = append(media, fmt.Sprintf(
+			`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="%s",NAME="%s",LANGUAGE="%s",DEFAULT=NO,AUTOSELECT=YES,URI="%s"`,
+			subtitleGroupID, hlsAttributeValue(caption.Label), caption.Language, playlistURL(caption.Language)))
+	}
+
+	lines := strings.Split(master, "\n")
+	out := make([]string, 0, len(lines)+len(media))
+	inserted := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			if !inserted {
+				out = append(out, media...)
+				inserted = true
+			}
+			line += fmt.Sprintf(`,SUBTITLES="%s"`, subtitleGroupID)
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// streamObjectKey joins a client supplied path onto baseDir, refusing
+// anything that would escape it.
+func streamObjectKey(baseDir, rel string) (string, bool) {
+	key := path.Join(baseDir, rel)
+	if !strings.HasPrefix(key, baseDir+"/") || validateObjectKey(key) != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// resolveStreamURI maps a URI found in a manifest at dir to a URL the
+// player can fetch. Nested playlists are routed back through the API under
+// route; everything else is signed directly.
+func (cfg *apiConfig) resolveStreamURI(ctx context.Context, videoID uuid.UUID, route, baseDir, dir, uri string) (string, error) {
+	if strings.Contains(uri, "://") {
+		return uri, nil
+	}
+	key, ok := streamObjectKey(baseDir, path.Join(dir, uri))
+	if !ok {
+		return "", fmt.Errorf("uri %q escapes the stream directory", uri)
+	}
+	if path.Ext(key) == ".m3u8" {
+		rel := strings.TrimPrefix(key, baseDir+"/")
+		return cfg.getVideoStreamURL(videoID, route, rel), nil
+	}
+	return cfg.urlSigner.SignURL(ctx, key, streamURLExpireTime)
+}
+
+// rewritePlaylist passes every URI in an m3u8 playlist through rewrite:
+// plain URI lines and URI="..." attributes on tags such as EXT-X-MAP and
+// EXT-X-MEDIA.
+func rewritePlaylist(playlist string, rewrite func(uri string) (string, error)) (string, error) {
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "#") {
+			uri, err := rewrite(trimmed)
+			if err != nil {
+				return "", err
+			}
+			lines[i] = uri
+			continue
+		}
+		var rewriteErr error
+		lines[i] = playlistURIAttr.ReplaceAllStringFunc(line, func(attr string) string {
+			uri, err := rewrite(playlistURIAttr.FindStringSubmatch(attr)[1])
+			if err != nil {
+				rewriteErr = err
+				return attr
+			}
+			return fmt.Sprintf(`URI="%s"`, uri)
+		})
+		if rewriteErr != nil {
+			return "", rewriteErr
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// handlerVideoDASH serves the DASH manifest for a video. Its
+// SegmentTemplate can't list a signed URL per segment, so the manifest is
+// returned unchanged and the relative segment requests it produces land back
+// on this route, which redirects each one to a signed URL.
+func (cfg *apiConfig) handlerVideoDASH(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	manifestKey, err := objectKeyFromReference(video.DASHURL)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Video has no DASH stream", err)
+		return
+	}
+
+	baseDir := path.Dir(manifestKey)
+	key, ok := streamObjectKey(baseDir, r.PathValue("path"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "File not found", nil)
+		return
+	}
+
+	if path.Ext(key) != ".mpd" {
+		url, err := cfg.urlSigner.SignURL(r.Context(), key, streamURLExpireTime)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign segment", err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	body, _, err := cfg.objectStore.Get(r.Context(), key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Manifest not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read manifest", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+}
+
+// handlerVideoStoryboard serves a video's WebVTT thumbnails track with each
+// sprite sheet reference replaced by a signed URL, keeping the #xywh=
+// fragment.
+func (cfg *apiConfig) handlerVideoStoryboard(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	vttKey, err := objectKeyFromReference(video.StoryboardVTTURL)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Video has no storyboard", err)
+		return
+	}
+
+	baseDir := path.Dir(vttKey)
+	key, ok := streamObjectKey(baseDir, r.PathValue("path"))
+	if !ok || path.Ext(key) != ".vtt" {
+		respondWithError(w, http.StatusNotFound, "Track not found", nil)
+		return
+	}
+
+	body, _, err := cfg.objectStore.Get(r.Context(), key)
+	if errors.Is(err, errObjectNotFound) {
+		respondWithError(w, http.StatusNotFound, "Track not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read track", err)
+		return
+	}
+	defer body.Close()
+	track, err := io.ReadAll(body)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read track", err)
+		return
+	}
+
+	signed := map[string]string{}
+	rewritten, err := rewriteVTTCues(string(track), func(uri string) (string, error) {
+		if url, ok := signed[uri]; ok {
+			return url, nil
+		}
+		url, err := cfg.resolveStreamURI(r.Context(), video.ID, "storyboard", baseDir, path.Dir(key), uri)
+		if err != nil {
+			return "", err
+		}
+		signed[uri] = url
+		return url, nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign track", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, rewritten)
+}
+
+// rewriteVTTCues passes the URI on the first payload line of every cue in
+// a WebVTT thumbnails track through rewrite. A #fragment is kept as is.
+func rewriteVTTCues(track string, rewrite func(uri string) (string, error)) (string, error) {
+	lines := strings.Split(track, "\n")
+	for i := 1; i < len(lines); i++ {
+		if !strings.Contains(lines[i-1], "-->") {
+			continue
+		}
+		payload := strings.TrimSpace(lines[i])
+		if payload == "" {
+			continue
+		}
+		uri, fragment, _ := strings.Cut(payload, "#")
+		url, err := rewrite(uri)
+		if err != nil {
+			return "", err
+		}
+		if fragment != "" {
+			url += "#" + fragment
+		}
+		lines[i] = url
+	}
+	return strings.Join(lines, "\n"), nil
+}
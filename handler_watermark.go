@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// The caller's watermark is managed at /api/users/watermark. It applies to
+// videos processed after it's set; published videos keep whatever they
+// were processed with.
+
+func (cfg *apiConfig) authenticateUser(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func (cfg *apiConfig) handlerWatermarkGet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark == nil {
+		respondWithError(w, http.StatusNotFound, "No watermark set", nil)
+		return
+	}
+	watermark.URL, err = cfg.urlSigner.SignURL(r.Context(), watermark.Key, streamURLExpireTime)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign watermark", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, watermark)
+}
+
+// handlerWatermarkUpload stores the caller's logo, the multipart file
+// "watermark", with optional "position", "opacity" and "scale" fields that
+// default to the deployment's settings.
+func (cfg *apiConfig) handlerWatermarkUpload(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+
+	const maxMemory = 10 << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxMemory)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+		return
+	}
+	file, header, err := r.FormFile("watermark")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Missing watermark file", err)
+		return
+	}
+	defer file.Close()
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Missing Content-Type for watermark", err)
+		return
+	}
+	switch mediaType {
+	case "image/png", "image/jpeg", "image/webp":
+	default:
+		respondWithError(w, http.StatusBadRequest, "Watermark must be PNG, JPEG or WebP", nil)
+		return
+	}
+
+	watermark := database.Watermark{
+		UserID:   userID,
+		Position: cfg.processing.watermark.position,
+		Opacity:  cfg.processing.watermark.opacity,
+		Scale:    cfg.processing.watermark.scale,
+	}
+	if position := r.FormValue("position"); position != "" {
+		watermark.Position = position
+	}
+	for field, dst := range map[string]*float64{"opacity": &watermark.Opacity, "scale": &watermark.Scale} {
+		value := r.FormValue(field)
+		if value == "" {
+			continue
+		}
+		*dst, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s must be a number", field), err)
+			return
+		}
+	}
+	if err := validateWatermarkSettings(watermark.Position, watermark.Opacity, watermark.Scale); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	if err := validateImage(file, mediaType); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+	previous, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+
+	watermark.Key = getRandomAssetPathWithPrefix(mediaType, fmt.Sprintf("watermarks/%s", userID))
+	if err := cfg.objectStore.Put(r.Context(), watermark.Key, file, mediaType); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store watermark", err)
+		return
+	}
+	if err := cfg.db.UpsertWatermark(watermark); err != nil {
+		cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, watermark.Key)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save watermark", err)
+		return
+	}
+	if previous != nil {
+		cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, previous.Key)
+	}
+
+	saved, err := cfg.db.GetWatermark(userID)
+	if err != nil || saved == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	saved.URL, _ = cfg.urlSigner.SignURL(r.Context(), saved.Key, streamURLExpireTime)
+	respondWithJSON(w, http.StatusOK, saved)
+}
+
+func (cfg *apiConfig) handlerWatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark == nil {
+		respondWithError(w, http.StatusNotFound, "No watermark set", nil)
+		return
+	}
+	if err := cfg.db.DeleteWatermark(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete watermark", err)
+		return
+	}
+	cfg.scheduleDeletion(r.Context(), database.DeletionKindObject, watermark.Key)
+	w.WriteHeader(http.StatusNoContent)
+}
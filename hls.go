@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// hlsRendition is one rung of the adaptive bitrate ladder. shortSide is the
+// height for landscape video and the width for portrait video, so "720p"
+// means the same quality in both orientations.
+type hlsRendition struct {
+	shortSide    int
+	videoBitrate int // kbps
+	portrait     bool
+}
+
+func (r hlsRendition) name() string {
+	return fmt.Sprintf("%dp", r.shortSide)
+}
+
+func (r hlsRendition) scaleFilter() string {
+	if r.portrait {
+		return fmt.Sprintf("scale=%d:-2", r.shortSide)
+	}
+	return fmt.Sprintf("scale=-2:%d", r.shortSide)
+}
+
+var defaultHLSBitrates = map[int]int{
+	2160: 14000,
+	1440: 8000,
+	1080: 5000,
+	720:  2800,
+	480:  1400,
+	360:  800,
+	240:  400,
+}
+
+func renditionBitrate(shortSide int) int {
+	if kbps, ok := defaultHLSBitrates[shortSide]; ok {
+		return kbps
+	}
+	// Roughly interpolate for sizes that aren't in the table.
+	return shortSide * shortSide / 200
+}
+
+// hlsLadder picks the configured rungs that don't upscale the source. A
+// source smaller than every rung still gets one rendition at its own size.
+// width and height are the display dimensions, after rotation.
+func hlsLadder(shortSides []int, width, height int) []hlsRendition {
+	portrait := width < height
+	sourceShort := min(width, height)
+	ladder := []hlsRendition{}
+	for _, side := range shortSides {
+		if side <= sourceShort {
+			ladder = append(ladder, hlsRendition{shortSide: side, videoBitrate: renditionBitrate(side), portrait: portrait})
+		}
+	}
+	if len(ladder) == 0 {
+		side := sourceShort &^ 1
+		ladder = append(ladder, hlsRendition{shortSide: side, videoBitrate: renditionBitrate(side), portrait: portrait})
+	}
+	return ladder
+}
+
+// ladderVideoArgs decodes filePath once, scales it to every rung of the
+// ladder and maps one libx264 output stream per rendition, in ladder order.
+func ladderVideoArgs(filePath string, ladder []hlsRendition) []string {
+	filter := fmt.Sprintf("[0:v]split=%d", len(ladder))
+	for i := range ladder {
+		filter += fmt.Sprintf("[v%d]", i)
+	}
+	for i, r := range ladder {
+		filter += fmt.Sprintf(";[v%d]%s[v%dout]", i, r.scaleFilter(), i)
+	}
+
+	args := []string{"-i", filePath, "-filter_complex", filter}
+	for i, r := range ladder {
+		args = append(args,
+			"-map", fmt.Sprintf("[v%dout]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", r.videoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", r.videoBitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", r.videoBitrate*3/2),
+		)
+	}
+	return append(args,
+		"-preset", "veryfast",
+		// Keyframes on segment boundaries so every rendition switches cleanly.
+		"-force_key_frames", "expr:gte(t,n_forced*6)",
+	)
+}
+
+// transcodeHLS encodes the ladder for the video at filePath into outDir with
+// a master.m3u8 referencing one index.m3u8 per rendition.
+func (cfg *apiConfig) transcodeHLS(ctx context.Context, filePath, outDir string, ladder []hlsRendition, hasAudio bool) error {
+	args := ladderVideoArgs(filePath, ladder)
+	streamMap := []string{}
+	for i, r := range ladder {
+		entry := fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			args = append(args, "-map", "a:0")
+			entry += fmt.Sprintf(",a:%d", i)
+		}
+		streamMap = append(streamMap, entry+",name:"+r.name())
+	}
+	if hasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", "128k", "-ac", "2")
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_filename", filepath.Join(outDir, "%v", "segment_%05d.ts"),
+		"-master_pl_name", "master.m3u8",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outDir, "%v", "index.m3u8"),
+	)
+	return cfg.transcoder.Transcode(ctx, args...)
+}
+
+// uploadDir stores every file under dir at prefix/<relative path> and
+// returns the keys it wrote.
+func (cfg *apiConfig) uploadDir(ctx context.Context, dir, prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := path.Join(prefix, filepath.ToSlash(rel))
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := cfg.objectStore.Put(ctx, key, f, streamingContentType(key)); err != nil {
+			return fmt.Errorf("put %s: %w", key, err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+func streamingContentType(key string) string {
+	switch path.Ext(key) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".mp4", ".m4s":
+		return "video/mp4"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".vtt":
+		return "text/vtt"
+	case ".jpg":
+		return "image/jpeg"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// streamLadder probes the processed file and picks its rendition ladder.
+func (cfg *apiConfig) streamLadder(ctx context.Context, filePath string) ([]hlsRendition, bool, error) {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	video, ok := probe.firstStream("video")
+	if !ok {
+		return nil, false, fmt.Errorf("no video stream")
+	}
+	_, hasAudio := probe.firstStream("audio")
+	width, height := video.displayDimensions()
+	return hlsLadder(cfg.processing.hlsRenditions, width, height), hasAudio, nil
+}
+
+// runHLSStage builds the ladder for the processed file and uploads it under
+// prefix/hls/. It returns the master playlist key and the ladder's start
+// PTS, or nil if it couldn't be read.
+func (cfg *apiConfig) runHLSStage(ctx context.Context, filePath, prefix string) (string, *int64, error) {
+	ladder, hasAudio, err := cfg.streamLadder(ctx, filePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	outDir, err := os.MkdirTemp(cfg.admission.scratchDir, "tubely-hls")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(outDir)
+
+	if err := cfg.transcodeHLS(ctx, filePath, outDir, ladder, hasAudio); err != nil {
+		return "", nil, fmt.Errorf("transcode hls: %w", err)
+	}
+	startPTS := cfg.hlsStartPTS(ctx, filepath.Join(outDir, ladder[0].name(), "segment_00000.ts"))
+	if _, err := cfg.uploadDir(ctx, outDir, prefix+"/hls"); err != nil {
+		return "", nil, err
+	}
+	return prefix + "/hls/master.m3u8", startPTS, nil
+}
+
+// hlsStartPTS reads the 90kHz start timestamp of an MPEG-TS segment. The
+// muxer doesn't start at zero, so WebVTT cues have to be mapped onto it.
+func (cfg *apiConfig) hlsStartPTS(ctx context.Context, segmentPath string) *int64 {
+	probe, err := cfg.prober.Probe(ctx, segmentPath)
+	if err != nil {
+		return nil
+	}
+	start, err := strconv.ParseFloat(probe.Format.StartTime, 64)
+	if err != nil || start < 0 {
+		return nil
+	}
+	pts := int64(math.Round(start * 90000))
+	return &pts
+}
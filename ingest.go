@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Uploads may arrive in any of these containers. Before the rest of the
+// pipeline runs, normalizeVideo turns videos into a faststart MP4 with H.264
+// video and AAC audio, copying whichever streams already qualify, and
+// normalizeAudio turns audio into an AAC M4A.
+
+var videoContainerExts = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/webm":       ".webm",
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"video/x-msvideo":  ".avi",
+}
+
+var audioContainerExts = map[string]string{
+	"audio/mpeg": ".mp3",
+	"audio/aac":  ".aac",
+	"audio/mp4":  ".m4a",
+	"audio/wav":  ".wav",
+	"audio/flac": ".flac",
+}
+
+// mediaTypeAliases are non-standard types browsers and tools send for the
+// same containers.
+var mediaTypeAliases = map[string]string{
+	"video/avi":      "video/x-msvideo",
+	"video/msvideo":  "video/x-msvideo",
+	"video/mkv":      "video/x-matroska",
+	"video/matroska": "video/x-matroska",
+	"audio/mp3":      "audio/mpeg",
+	"audio/x-aac":    "audio/aac",
+	"audio/x-m4a":    "audio/mp4",
+	"audio/m4a":      "audio/mp4",
+	"audio/x-wav":    "audio/wav",
+	"audio/wave":     "audio/wav",
+	"audio/vnd.wave": "audio/wav",
+	"audio/x-flac":   "audio/flac",
+}
+
+func canonicalMediaType(mediaType string) string {
+	if canonical, ok := mediaTypeAliases[mediaType]; ok {
+		return canonical
+	}
+	return mediaType
+}
+
+// mediaKindOf says whether an accepted upload type is processed as a video
+// or as audio.
+func mediaKindOf(mediaType string) string {
+	if _, ok := audioContainerExts[mediaType]; ok {
+		return database.MediaKindAudio
+	}
+	return database.MediaKindVideo
+}
+
+// validateMediaTypes checks a configured allow-list only names containers
+// the normalizer understands, those in known.
+func validateMediaTypes(mediaTypes []string, known map[string]string) error {
+	for _, mediaType := range mediaTypes {
+		if _, ok := known[mediaType]; !ok {
+			return fmt.Errorf("unsupported type %q", mediaType)
+		}
+	}
+	return nil
+}
+
+// acceptMediaType returns the canonical form of an upload's media type, and
+// whether this deployment accepts it as either video or audio.
+func (cfg *apiConfig) acceptMediaType(mediaType string) (string, bool) {
+	mediaType = canonicalMediaType(mediaType)
+	return mediaType, slices.Contains(cfg.processing.videoTypes, mediaType) || slices.Contains(cfg.processing.audioTypes, mediaType)
+}
+
+func uploadMediaTypeToExt(mediaType string) string {
+	if ext, ok := videoContainerExts[mediaType]; ok {
+		return ext
+	}
+	if ext, ok := audioContainerExts[mediaType]; ok {
+		return ext
+	}
+	return mediaTypeToExt(mediaType)
+}
+
+// normalizeVideo writes a faststart MP4 of the first video and audio stream
+// of filePath and returns its path. Streams are copied when they're already
+// H.264 (4:2:0) or AAC and re-encoded otherwise.
+func (cfg *apiConfig) normalizeVideo(ctx context.Context, filePath string) (string, error) {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	video, ok := probe.firstStream("video")
+	if !ok {
+		return "", fmt.Errorf("%w: no video stream", errPermanent)
+	}
+	audio, hasAudio := probe.firstStream("audio")
+
+	args := []string{"-i", filePath, "-map", "0:v:0"}
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+	}
+	copyVideo := video.CodecName == "h264" && (video.PixFmt == "yuv420p" || video.PixFmt == "yuvj420p")
+	if copyVideo {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p")
+	}
+	copyAudio := audio.CodecName == "aac"
+	if hasAudio {
+		if copyAudio {
+			args = append(args, "-c:a", "copy")
+		} else {
+			args = append(args, "-c:a", "aac", "-b:a", "160k")
+		}
+	}
+	log.Printf("normalize %s (%s): copy video %t, copy audio %t", filePath, probe.Format.FormatName, copyVideo, copyAudio || !hasAudio)
+
+	output := filePath + ".processing"
+	args = append(args, "-movflags", "faststart", "-f", "mp4", output)
+	if err := cfg.transcoder.Transcode(ctx, args...); err != nil {
+		return "", err
+	}
+	return output, nil
+}
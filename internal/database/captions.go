@@ -0,0 +1,134 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Caption is a WebVTT subtitle track for one language of a video. Key is
+// the object holding the converted track.
+type Caption struct {
+	ID              uuid.UUID `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	VideoID         uuid.UUID `json:"video_id"`
+	Language        string    `json:"language"`
+	Label           string    `json:"label"`
+	Key             string    `json:"-"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// URL isn't a column; handlers fill it with a signed URL.
+	URL string `json:"url,omitempty"`
+}
+
+const captionColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		key,
+		duration_seconds
+`
+
+func scanCaption(row rowScanner) (Caption, error) {
+	var caption Caption
+	err := row.Scan(
+		&caption.ID,
+		&caption.CreatedAt,
+		&caption.UpdatedAt,
+		&caption.VideoID,
+		&caption.Language,
+		&caption.Label,
+		&caption.Key,
+		&caption.DurationSeconds,
+	)
+	return caption, err
+}
+
+type CreateCaptionParams struct {
+	VideoID         uuid.UUID
+	Language        string
+	Label           string
+	Key             string
+	DurationSeconds float64
+}
+
+func (c Client) CreateCaption(params CreateCaptionParams) (Caption, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO captions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		key,
+		duration_seconds
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.Language, params.Label, params.Key, params.DurationSeconds)
+	if err != nil {
+		return Caption{}, err
+	}
+	return c.GetCaption(params.VideoID, params.Language)
+}
+
+// GetCaption returns a zero Caption if the video has no track in language.
+func (c Client) GetCaption(videoID uuid.UUID, language string) (Caption, error) {
+	query := `SELECT` + captionColumns + `FROM captions WHERE video_id = ? AND language = ?`
+	caption, err := scanCaption(c.db.QueryRow(query, videoID, language))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Caption{}, nil
+		}
+		return Caption{}, err
+	}
+	return caption, nil
+}
+
+func (c Client) GetCaptions(videoID uuid.UUID) ([]Caption, error) {
+	query := `SELECT` + captionColumns + `FROM captions
+	WHERE video_id = ?
+	ORDER BY language
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captions := []Caption{}
+	for rows.Next() {
+		caption, err := scanCaption(rows)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, caption)
+	}
+	return captions, rows.Err()
+}
+
+// UpdateCaption stores a replacement track for caption.ID.
+func (c Client) UpdateCaption(caption Caption) error {
+	query := `
+	UPDATE captions
+	SET
+		label = ?,
+		key = ?,
+		duration_seconds = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, caption.Label, caption.Key, caption.DurationSeconds, caption.ID)
+	return err
+}
+
+func (c Client) DeleteCaption(id uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM captions WHERE id = ?`, id)
+	return err
+}
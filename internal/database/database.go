@@ -11,6 +11,11 @@ type Client struct {
 	db *sql.DB
 }
 
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
 func NewClient(pathToDB string) (Client, error) {
 	db, err := sql.Open("sqlite3", pathToDB)
 	if err != nil {
@@ -72,10 +77,227 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfMissing("videos", "hls_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "dash_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "hls_start_pts", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "storyboard_vtt_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "source_video_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "media_kind", "TEXT NOT NULL DEFAULT 'video'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "waveform_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "thumbnail_generated", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "thumbnails", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	uploadSessionTable := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		path TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+	);
+	`
+	_, err = c.db.Exec(uploadSessionTable)
+	if err != nil {
+		return err
+	}
+
+	pendingDeletionTable := `
+	CREATE TABLE IF NOT EXISTS pending_deletions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		kind TEXT NOT NULL,
+		key TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(pendingDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	videoMetadataTable := `
+	CREATE TABLE IF NOT EXISTS video_metadata (
+		video_id TEXT PRIMARY KEY,
+		probed_at TIMESTAMP NOT NULL,
+		duration_seconds REAL NOT NULL,
+		container TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		bit_rate INTEGER NOT NULL,
+		video_codec TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		frame_rate REAL NOT NULL,
+		rotation INTEGER NOT NULL,
+		pixel_format TEXT NOT NULL,
+		audio_codec TEXT,
+		audio_channels INTEGER,
+		audio_sample_rate INTEGER,
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS video_metadata_video_codec ON video_metadata (video_codec);
+	CREATE INDEX IF NOT EXISTS video_metadata_audio_codec ON video_metadata (audio_codec);
+	`
+	_, err = c.db.Exec(videoMetadataTable)
+	if err != nil {
+		return err
+	}
+	for _, column := range []string{"loudness_integrated", "loudness_range", "loudness_true_peak", "loudness_target"} {
+		err = c.addColumnIfMissing("video_metadata", column, "REAL")
+		if err != nil {
+			return err
+		}
+	}
+
+	captionTable := `
+	CREATE TABLE IF NOT EXISTS captions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL,
+		key TEXT NOT NULL,
+		duration_seconds REAL NOT NULL,
+		UNIQUE(video_id, language),
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+	);
+	`
+	_, err = c.db.Exec(captionTable)
+	if err != nil {
+		return err
+	}
+
+	watermarkTable := `
+	CREATE TABLE IF NOT EXISTS watermarks (
+		user_id TEXT PRIMARY KEY,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		key TEXT NOT NULL,
+		position TEXT NOT NULL,
+		opacity REAL NOT NULL,
+		scale REAL NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`
+	_, err = c.db.Exec(watermarkTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		error TEXT,
+		run_at TIMESTAMP NOT NULL,
+		started_at TIMESTAMP,
+		finished_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs (status, run_at);
+	CREATE INDEX IF NOT EXISTS jobs_video_id ON jobs (video_id);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// addColumnIfMissing extends an existing table created before the column
+// was introduced. CREATE TABLE IF NOT EXISTS leaves old tables untouched.
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func (c Client) Reset() error {
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM watermarks"); err != nil {
+		return fmt.Errorf("failed to reset table watermarks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM captions"); err != nil {
+		return fmt.Errorf("failed to reset table captions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_metadata"); err != nil {
+		return fmt.Errorf("failed to reset table video_metadata: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM pending_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table pending_deletions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table upload_sessions: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
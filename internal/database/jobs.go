@@ -0,0 +1,261 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+type Job struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Error      *string    `json:"error"`
+	RunAt      time.Time  `json:"run_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	Kind        string    `json:"kind"`
+	Payload     string    `json:"-"`
+	MaxAttempts int       `json:"max_attempts"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		kind,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		error,
+		run_at,
+		started_at,
+		finished_at
+`
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.VideoID,
+		&job.Kind,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.Error,
+		&job.RunAt,
+		&job.StartedAt,
+		&job.FinishedAt,
+	)
+	return job, err
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		kind,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		id,
+		params.VideoID,
+		params.Kind,
+		params.Payload,
+		JobStatusQueued,
+		params.MaxAttempts,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `SELECT` + jobColumns + `FROM jobs WHERE id = ?`
+	job, err := scanJob(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// GetLatestJob returns the most recently created job of the given kind for
+// a video, or a zero Job if there is none.
+func (c Client) GetLatestJob(videoID uuid.UUID, kind string) (Job, error) {
+	query := `SELECT` + jobColumns + `FROM jobs
+	WHERE video_id = ? AND kind = ?
+	ORDER BY created_at DESC, rowid DESC
+	LIMIT 1
+	`
+	job, err := scanJob(c.db.QueryRow(query, videoID, kind))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// GetActiveJobs returns a video's queued and running jobs of the given
+// kind, oldest first.
+func (c Client) GetActiveJobs(videoID uuid.UUID, kind string) ([]Job, error) {
+	query := `SELECT` + jobColumns + `FROM jobs
+	WHERE video_id = ? AND kind = ? AND status IN (?, ?)
+	ORDER BY created_at, rowid
+	`
+	rows, err := c.db.Query(query, videoID, kind, JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimNextJob atomically moves the oldest due queued job to running and
+// returns it. ok is false when there is nothing to do.
+func (c Client) ClaimNextJob(now time.Time) (job Job, ok bool, err error) {
+	for {
+		query := `SELECT` + jobColumns + `FROM jobs
+		WHERE status = ? AND run_at <= ?
+		ORDER BY run_at
+		LIMIT 1
+		`
+		job, err = scanJob(c.db.QueryRow(query, JobStatusQueued, now))
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, false, nil
+		}
+		if err != nil {
+			return Job{}, false, err
+		}
+
+		claim := `
+		UPDATE jobs
+		SET
+			status = ?,
+			attempts = attempts + 1,
+			started_at = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ?
+		`
+		res, err := c.db.Exec(claim, JobStatusRunning, now, job.ID, JobStatusQueued)
+		if err != nil {
+			return Job{}, false, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return Job{}, false, err
+		}
+		if n == 1 {
+			job.Status = JobStatusRunning
+			job.Attempts++
+			job.StartedAt = &now
+			return job, true, nil
+		}
+		// Another worker claimed it first; look for the next one.
+	}
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		error = NULL,
+		finished_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusSucceeded, id)
+	return err
+}
+
+// RetryJob puts a failed job back in the queue to run again at runAt.
+func (c Client) RetryJob(id uuid.UUID, jobErr string, runAt time.Time) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		error = ?,
+		run_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusQueued, jobErr, runAt, id)
+	return err
+}
+
+func (c Client) FailJob(id uuid.UUID, jobErr string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		error = ?,
+		finished_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusFailed, jobErr, id)
+	return err
+}
+
+// RequeueRunningJobs resets jobs that were running when the server stopped.
+func (c Client) RequeueRunningJobs() (int64, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ?
+	`
+	res, err := c.db.Exec(query, JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DeletionKindObject = "object"
+	DeletionKindAsset  = "asset"
+)
+
+// PendingDeletion is a stored object or asset file that should be removed.
+// Rows stay in the table until the delete succeeds.
+type PendingDeletion struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	Kind          string    `json:"kind"`
+	Key           string    `json:"key"`
+	Attempts      int       `json:"attempts"`
+	LastError     *string   `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+func (c Client) CreatePendingDeletion(kind, key string) (PendingDeletion, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO pending_deletions (
+		id,
+		created_at,
+		kind,
+		key,
+		attempts,
+		next_attempt_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, 0, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, id, kind, key)
+	if err != nil {
+		return PendingDeletion{}, err
+	}
+
+	return PendingDeletion{
+		ID:            id,
+		CreatedAt:     time.Now().UTC(),
+		Kind:          kind,
+		Key:           key,
+		NextAttemptAt: time.Now().UTC(),
+	}, nil
+}
+
+func (c Client) GetDuePendingDeletions(now time.Time, limit int) ([]PendingDeletion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		kind,
+		key,
+		attempts,
+		last_error,
+		next_attempt_at
+	FROM pending_deletions
+	WHERE next_attempt_at <= ?
+	ORDER BY next_attempt_at
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []PendingDeletion{}
+	for rows.Next() {
+		var d PendingDeletion
+		if err := rows.Scan(
+			&d.ID,
+			&d.CreatedAt,
+			&d.Kind,
+			&d.Key,
+			&d.Attempts,
+			&d.LastError,
+			&d.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+
+	return deletions, rows.Err()
+}
+
+func (c Client) RetryPendingDeletion(id uuid.UUID, lastError string, nextAttemptAt time.Time) error {
+	query := `
+	UPDATE pending_deletions
+	SET
+		attempts = attempts + 1,
+		last_error = ?,
+		next_attempt_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, lastError, nextAttemptAt, id)
+	return err
+}
+
+func (c Client) DeletePendingDeletion(id uuid.UUID) error {
+	query := `
+	DELETE FROM pending_deletions
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
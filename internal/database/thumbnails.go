@@ -0,0 +1,48 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Thumbnails holds the resized variants of a video's thumbnail keyed by
+// format ("jpeg", "webp"). It's stored as JSON in videos.thumbnails.
+type Thumbnails map[string]ThumbnailSet
+
+type ThumbnailSet struct {
+	// Srcset is ready to drop into an <img srcset> or <source srcset>.
+	Srcset string           `json:"srcset"`
+	Images []ThumbnailImage `json:"images"`
+}
+
+type ThumbnailImage struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+func (t Thumbnails) Value() (driver.Value, error) {
+	if t == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (t *Thumbnails) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), t)
+	case []byte:
+		return json.Unmarshal(v, t)
+	default:
+		return fmt.Errorf("can't scan %T into Thumbnails", src)
+	}
+}
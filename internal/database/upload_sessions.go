@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UploadSession struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Offset      int64      `json:"offset"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreateUploadSessionParams
+}
+
+type CreateUploadSessionParams struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	UserID      uuid.UUID `json:"user_id"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Filename    string    `json:"filename"`
+	Path        string    `json:"-"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (c Client) CreateUploadSession(params CreateUploadSessionParams) (UploadSession, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO upload_sessions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		size,
+		upload_offset,
+		content_type,
+		filename,
+		path,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query,
+		id,
+		params.VideoID,
+		params.UserID,
+		params.Size,
+		params.ContentType,
+		params.Filename,
+		params.Path,
+		params.ExpiresAt,
+	)
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	return c.GetUploadSession(id)
+}
+
+func (c Client) GetUploadSession(id uuid.UUID) (UploadSession, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		size,
+		upload_offset,
+		content_type,
+		filename,
+		path,
+		expires_at,
+		completed_at
+	FROM upload_sessions
+	WHERE id = ?
+	`
+
+	var session UploadSession
+	err := c.db.QueryRow(query, id).Scan(
+		&session.ID,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+		&session.VideoID,
+		&session.UserID,
+		&session.Size,
+		&session.Offset,
+		&session.ContentType,
+		&session.Filename,
+		&session.Path,
+		&session.ExpiresAt,
+		&session.CompletedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadSession{}, nil
+		}
+		return UploadSession{}, err
+	}
+
+	return session, nil
+}
+
+func (c Client) UpdateUploadSessionOffset(id uuid.UUID, offset int64) error {
+	query := `
+	UPDATE upload_sessions
+	SET
+		upload_offset = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, id)
+	return err
+}
+
+func (c Client) CompleteUploadSession(id uuid.UUID) error {
+	query := `
+	UPDATE upload_sessions
+	SET
+		completed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+// GetExpiredUploadSessions returns unfinished sessions whose expiry has
+// passed, so their partial files can be removed.
+func (c Client) GetExpiredUploadSessions(now time.Time) ([]UploadSession, error) {
+	query := `
+	SELECT id, path
+	FROM upload_sessions
+	WHERE completed_at IS NULL AND expires_at < ?
+	`
+
+	rows, err := c.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []UploadSession{}
+	for rows.Next() {
+		var session UploadSession
+		if err := rows.Scan(&session.ID, &session.Path); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (c Client) DeleteUploadSession(id uuid.UUID) error {
+	query := `
+	DELETE FROM upload_sessions
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
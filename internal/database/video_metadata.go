@@ -0,0 +1,169 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoMetadata is what ffprobe reported about a video's processed file.
+// Audio fields are nil for videos without an audio stream, and video fields
+// zero for audio-only uploads.
+type VideoMetadata struct {
+	VideoID         uuid.UUID `json:"-"`
+	ProbedAt        time.Time `json:"probed_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Container       string    `json:"container"`
+	SizeBytes       int64     `json:"size_bytes"`
+	BitRate         int64     `json:"bit_rate"`
+	VideoCodec      string    `json:"video_codec"`
+	Width           int       `json:"width"`
+	Height          int       `json:"height"`
+	FrameRate       float64   `json:"frame_rate"`
+	Rotation        int       `json:"rotation"`
+	PixelFormat     string    `json:"pixel_format"`
+	AudioCodec      *string   `json:"audio_codec"`
+	AudioChannels   *int      `json:"audio_channels"`
+	AudioSampleRate *int      `json:"audio_sample_rate"`
+	// The loudness fields are the EBU R128 measurement of the audio as
+	// uploaded, and the integrated loudness it was normalized to. They're
+	// nil unless loudness normalization ran.
+	LoudnessIntegrated *float64 `json:"loudness_integrated"` // LUFS
+	LoudnessRange      *float64 `json:"loudness_range"`      // LU
+	LoudnessTruePeak   *float64 `json:"loudness_true_peak"`  // dBTP
+	LoudnessTarget     *float64 `json:"loudness_target"`     // LUFS
+}
+
+const videoMetadataColumns = `
+		video_id,
+		probed_at,
+		duration_seconds,
+		container,
+		size_bytes,
+		bit_rate,
+		video_codec,
+		width,
+		height,
+		frame_rate,
+		rotation,
+		pixel_format,
+		audio_codec,
+		audio_channels,
+		audio_sample_rate,
+		loudness_integrated,
+		loudness_range,
+		loudness_true_peak,
+		loudness_target
+`
+
+func scanVideoMetadata(row rowScanner) (VideoMetadata, error) {
+	var metadata VideoMetadata
+	err := row.Scan(
+		&metadata.VideoID,
+		&metadata.ProbedAt,
+		&metadata.DurationSeconds,
+		&metadata.Container,
+		&metadata.SizeBytes,
+		&metadata.BitRate,
+		&metadata.VideoCodec,
+		&metadata.Width,
+		&metadata.Height,
+		&metadata.FrameRate,
+		&metadata.Rotation,
+		&metadata.PixelFormat,
+		&metadata.AudioCodec,
+		&metadata.AudioChannels,
+		&metadata.AudioSampleRate,
+		&metadata.LoudnessIntegrated,
+		&metadata.LoudnessRange,
+		&metadata.LoudnessTruePeak,
+		&metadata.LoudnessTarget,
+	)
+	return metadata, err
+}
+
+// UpsertVideoMetadata replaces the metadata stored for metadata.VideoID.
+func (c Client) UpsertVideoMetadata(metadata VideoMetadata) error {
+	query := `
+	INSERT INTO video_metadata (` + videoMetadataColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (video_id) DO UPDATE SET
+		probed_at = excluded.probed_at,
+		duration_seconds = excluded.duration_seconds,
+		container = excluded.container,
+		size_bytes = excluded.size_bytes,
+		bit_rate = excluded.bit_rate,
+		video_codec = excluded.video_codec,
+		width = excluded.width,
+		height = excluded.height,
+		frame_rate = excluded.frame_rate,
+		rotation = excluded.rotation,
+		pixel_format = excluded.pixel_format,
+		audio_codec = excluded.audio_codec,
+		audio_channels = excluded.audio_channels,
+		audio_sample_rate = excluded.audio_sample_rate,
+		loudness_integrated = excluded.loudness_integrated,
+		loudness_range = excluded.loudness_range,
+		loudness_true_peak = excluded.loudness_true_peak,
+		loudness_target = excluded.loudness_target
+	`
+	_, err := c.db.Exec(query,
+		metadata.VideoID,
+		metadata.ProbedAt,
+		metadata.DurationSeconds,
+		metadata.Container,
+		metadata.SizeBytes,
+		metadata.BitRate,
+		metadata.VideoCodec,
+		metadata.Width,
+		metadata.Height,
+		metadata.FrameRate,
+		metadata.Rotation,
+		metadata.PixelFormat,
+		metadata.AudioCodec,
+		metadata.AudioChannels,
+		metadata.AudioSampleRate,
+		metadata.LoudnessIntegrated,
+		metadata.LoudnessRange,
+		metadata.LoudnessTruePeak,
+		metadata.LoudnessTarget,
+	)
+	return err
+}
+
+// GetVideoMetadata returns nil if the video hasn't been probed yet.
+func (c Client) GetVideoMetadata(videoID uuid.UUID) (*VideoMetadata, error) {
+	query := `SELECT` + videoMetadataColumns + `FROM video_metadata WHERE video_id = ?`
+	metadata, err := scanVideoMetadata(c.db.QueryRow(query, videoID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// GetVideoMetadataForUser returns the metadata of every probed video the
+// user owns, keyed by video ID.
+func (c Client) GetVideoMetadataForUser(userID uuid.UUID) (map[uuid.UUID]VideoMetadata, error) {
+	query := `SELECT` + videoMetadataColumns + `FROM video_metadata
+	WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := map[uuid.UUID]VideoMetadata{}
+	for rows.Next() {
+		m, err := scanVideoMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		metadata[m.VideoID] = m
+	}
+	return metadata, rows.Err()
+}
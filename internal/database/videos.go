@@ -8,12 +8,36 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	MediaKindVideo = "video"
+	MediaKindAudio = "audio"
+)
+
 type Video struct {
 	ID           uuid.UUID `json:"id"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// ThumbnailGenerated is true when the thumbnail was extracted from the
+	// video rather than uploaded by the user.
+	ThumbnailGenerated bool       `json:"thumbnail_generated"`
+	Thumbnails         Thumbnails `json:"thumbnails"`
+	VideoURL           *string    `json:"video_url"`
+	HLSURL             *string    `json:"hls_url"`
+	DASHURL            *string    `json:"dash_url"`
+	// HLSStartPTS is the 90kHz timestamp the MPEG-TS ladder starts at,
+	// which caption tracks are mapped onto.
+	HLSStartPTS      *int64  `json:"-"`
+	StoryboardVTTURL *string `json:"storyboard_vtt_url"`
+	// SourceVideoID is the video a clip was cut from.
+	SourceVideoID *uuid.UUID `json:"source_video_id"`
+	// MediaKind is MediaKindVideo or, for audio-only uploads,
+	// MediaKindAudio.
+	MediaKind string `json:"media_kind"`
+	// WaveformURL points at the peak data of audio uploads.
+	WaveformURL *string `json:"waveform_url"`
+	// Metadata isn't a column; handlers fill it from GetVideoMetadata.
+	Metadata *VideoMetadata `json:"metadata,omitempty"`
 	CreateVideoParams
 }
 
@@ -23,18 +47,52 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_generated,
+		thumbnails,
 		video_url,
+		hls_url,
+		dash_url,
+		hls_start_pts,
+		storyboard_vtt_url,
+		source_video_id,
+		media_kind,
+		waveform_url,
 		user_id
-	FROM videos
+`
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailGenerated,
+		&video.Thumbnails,
+		&video.VideoURL,
+		&video.HLSURL,
+		&video.DASHURL,
+		&video.HLSStartPTS,
+		&video.StoryboardVTTURL,
+		&video.SourceVideoID,
+		&video.MediaKind,
+		&video.WaveformURL,
+		&video.UserID,
+	)
+	return video, err
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `SELECT` + videoColumns + `FROM videos
 	WHERE user_id = ?
 	ORDER BY created_at DESC
 	`
@@ -47,17 +105,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -87,30 +136,9 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 }
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE id = ?
-	`
+	query := `SELECT` + videoColumns + `FROM videos WHERE id = ?`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -128,8 +156,18 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_generated = ?,
+		thumbnails = ?,
 		video_url = ?,
-		user_id = ?
+		hls_url = ?,
+		dash_url = ?,
+		hls_start_pts = ?,
+		storyboard_vtt_url = ?,
+		source_video_id = ?,
+		media_kind = ?,
+		waveform_url = ?,
+		user_id = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
 
@@ -138,18 +176,111 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		&video.ThumbnailGenerated,
+		video.Thumbnails,
 		&video.VideoURL,
+		&video.HLSURL,
+		&video.DASHURL,
+		video.HLSStartPTS,
+		&video.StoryboardVTTURL,
+		video.SourceVideoID,
+		video.MediaKind,
+		&video.WaveformURL,
 		video.UserID,
 		video.ID,
 	)
 	return err
 }
 
+// UpdateVideoProcessingOutputs saves only the columns the processing
+// pipeline owns, so edits the user made while a video was being processed,
+// such as a new title or thumbnail, aren't overwritten.
+func (c Client) UpdateVideoProcessingOutputs(video Video) error {
+	query := `
+	UPDATE videos
+	SET
+		video_url = ?,
+		hls_url = ?,
+		dash_url = ?,
+		hls_start_pts = ?,
+		storyboard_vtt_url = ?,
+		media_kind = ?,
+		waveform_url = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+
+	_, err := c.db.Exec(
+		query,
+		video.VideoURL,
+		video.HLSURL,
+		video.DASHURL,
+		video.HLSStartPTS,
+		video.StoryboardVTTURL,
+		video.MediaKind,
+		video.WaveformURL,
+		video.ID,
+	)
+	return err
+}
+
+// VideoReference is the subset of a video row that points at stored files.
+type VideoReference struct {
+	ID           uuid.UUID
+	CreatedAt    time.Time
+	ThumbnailURL *string
+	Thumbnails   Thumbnails
+	VideoURL     *string
+}
+
+func (c Client) GetVideoReferences() ([]VideoReference, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		thumbnail_url,
+		thumbnails,
+		video_url
+	FROM videos
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []VideoReference{}
+	for rows.Next() {
+		var ref VideoReference
+		if err := rows.Scan(
+			&ref.ID,
+			&ref.CreatedAt,
+			&ref.ThumbnailURL,
+			&ref.Thumbnails,
+			&ref.VideoURL,
+		); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
 	_, err := c.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM video_metadata WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM captions WHERE video_id = ?`, id)
 	return err
 }
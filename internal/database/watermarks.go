@@ -0,0 +1,105 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Watermark is a user's logo and how it's laid over their videos. Scale is
+// the logo's width as a fraction of the video's.
+type Watermark struct {
+	UserID    uuid.UUID `json:"user_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Key       string    `json:"-"`
+	Position  string    `json:"position"`
+	Opacity   float64   `json:"opacity"`
+	Scale     float64   `json:"scale"`
+	// URL isn't a column; handlers fill it with a signed URL.
+	URL string `json:"url,omitempty"`
+}
+
+// UpsertWatermark replaces the watermark stored for watermark.UserID.
+func (c Client) UpsertWatermark(watermark Watermark) error {
+	query := `
+	INSERT INTO watermarks (
+		user_id,
+		updated_at,
+		key,
+		position,
+		opacity,
+		scale
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	ON CONFLICT (user_id) DO UPDATE SET
+		updated_at = excluded.updated_at,
+		key = excluded.key,
+		position = excluded.position,
+		opacity = excluded.opacity,
+		scale = excluded.scale
+	`
+	_, err := c.db.Exec(query,
+		watermark.UserID,
+		watermark.Key,
+		watermark.Position,
+		watermark.Opacity,
+		watermark.Scale,
+	)
+	return err
+}
+
+// GetWatermark returns nil if the user hasn't uploaded a watermark.
+func (c Client) GetWatermark(userID uuid.UUID) (*Watermark, error) {
+	query := `
+	SELECT
+		user_id,
+		updated_at,
+		key,
+		position,
+		opacity,
+		scale
+	FROM watermarks
+	WHERE user_id = ?
+	`
+	var watermark Watermark
+	err := c.db.QueryRow(query, userID).Scan(
+		&watermark.UserID,
+		&watermark.UpdatedAt,
+		&watermark.Key,
+		&watermark.Position,
+		&watermark.Opacity,
+		&watermark.Scale,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &watermark, nil
+}
+
+func (c Client) DeleteWatermark(userID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM watermarks WHERE user_id = ?`, userID)
+	return err
+}
+
+// GetWatermarkKeys returns the object key of every stored watermark.
+func (c Client) GetWatermarkKeys() ([]string, error) {
+	rows, err := c.db.Query(`SELECT key FROM watermarks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Video processing runs outside the request. Upload handlers store the raw
+// file under the video's uploads/ prefix and enqueue a job; a pool of
+// workers polls the jobs table, so queued work survives restarts.
+
+const (
+	jobKindProcessVideo      = "process_video"
+	jobKindGenerateThumbnail = "generate_thumbnail"
+
+	defaultJobMaxAttempts = 5
+	jobPollInterval       = 5 * time.Second
+	jobBaseBackoff        = 30 * time.Second
+	jobMaxBackoff         = time.Hour
+)
+
+// errPermanent marks job failures that retrying can't fix.
+var errPermanent = errors.New("permanent job failure")
+
+type processVideoPayload struct {
+	RawKey    string `json:"raw_key"`
+	MediaType string `json:"media_type"`
+}
+
+type jobQueue struct {
+	db     database.Client
+	wakeup chan struct{}
+	// timeout bounds a single attempt, cancelling any ffmpeg it started.
+	// Zero means no limit.
+	timeout time.Duration
+	events  *videoEventHub
+}
+
+// videoEventJobKinds are the jobs whose progress is published on the
+// video's event stream.
+var videoEventJobKinds = map[string]bool{
+	jobKindProcessVideo: true,
+	jobKindCreateClip:   true,
+}
+
+// latestVideoJob returns the video's most recent processing or clip job,
+// or a zero Job if it has none.
+func (cfg *apiConfig) latestVideoJob(videoID uuid.UUID) (database.Job, error) {
+	var latest database.Job
+	for kind := range videoEventJobKinds {
+		job, err := cfg.db.GetLatestJob(videoID, kind)
+		if err != nil {
+			return database.Job{}, err
+		}
+		if job.ID != uuid.Nil && job.CreatedAt.After(latest.CreatedAt) {
+			latest = job
+		}
+	}
+	return latest, nil
+}
+
+func newJobQueue(db database.Client, timeout time.Duration, events *videoEventHub) *jobQueue {
+	return &jobQueue{
+		db:      db,
+		wakeup:  make(chan struct{}, 1),
+		timeout: timeout,
+		events:  events,
+	}
+}
+
+func (q *jobQueue) enqueue(videoID uuid.UUID, kind string, payload any) (database.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := q.db.CreateJob(database.CreateJobParams{
+		VideoID:     videoID,
+		Kind:        kind,
+		Payload:     string(data),
+		MaxAttempts: defaultJobMaxAttempts,
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+	if videoEventJobKinds[kind] {
+		q.events.publish(videoEvent{Type: videoEventQueued, VideoID: videoID})
+	}
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// enqueueVideoProcessing uploads the raw file at rawPath and queues it for
+// processing.
+func (cfg *apiConfig) enqueueVideoProcessing(ctx context.Context, videoID uuid.UUID, rawPath, mediaType string) (database.Job, error) {
+	rawKey := directUploadPrefix(videoID) + uuid.NewString() + uploadMediaTypeToExt(mediaType)
+	if err := cfg.uploadVideoFile(ctx, rawKey, rawPath, mediaType); err != nil {
+		return database.Job{}, fmt.Errorf("store raw upload: %w", err)
+	}
+	return cfg.jobs.enqueue(videoID, jobKindProcessVideo, processVideoPayload{
+		RawKey:    rawKey,
+		MediaType: mediaType,
+	})
+}
+
+func (cfg *apiConfig) startJobWorkers(n int) {
+	requeued, err := cfg.db.RequeueRunningJobs()
+	if err != nil {
+		log.Printf("Couldn't requeue interrupted jobs: %v", err)
+	} else if requeued > 0 {
+		log.Printf("Requeued %d interrupted jobs", requeued)
+	}
+	for i := 0; i < n; i++ {
+		go cfg.runJobWorker()
+	}
+}
+
+func (cfg *apiConfig) runJobWorker() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		for cfg.runNextJob() {
+		}
+		select {
+		case <-cfg.jobs.wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNextJob claims and runs one job. It reports whether a job was found so
+// the worker can keep draining the queue before sleeping.
+func (cfg *apiConfig) runNextJob() bool {
+	// Leave jobs queued rather than fail them halfway through writing
+	// intermediates to a full disk.
+	if err := cfg.hasDiskSpace(cfg.admission.scratchDir, -1); err != nil {
+		log.Printf("Not starting jobs: %v", err)
+		return false
+	}
+	job, ok, err := cfg.db.ClaimNextJob(time.Now().UTC())
+	if err != nil {
+		log.Printf("Couldn't claim job: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if cfg.jobs.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.jobs.timeout)
+	}
+	err = cfg.runJob(ctx, job)
+	cancel()
+	publish := func(event videoEvent) {
+		if videoEventJobKinds[job.Kind] {
+			event.VideoID = job.VideoID
+			cfg.events.publish(event)
+		}
+	}
+	if err == nil {
+		if err := cfg.db.CompleteJob(job.ID); err != nil {
+			log.Printf("Couldn't mark job %s complete: %v", job.ID, err)
+		}
+		publish(videoEvent{Type: videoEventReady})
+		return true
+	}
+
+	log.Printf("Job %s (%s) attempt %d failed: %v", job.ID, job.Kind, job.Attempts, err)
+	if errors.Is(err, errPermanent) || job.Attempts >= job.MaxAttempts {
+		if err := cfg.db.FailJob(job.ID, err.Error()); err != nil {
+			log.Printf("Couldn't mark job %s failed: %v", job.ID, err)
+		}
+		publish(videoEvent{Type: videoEventFailed, Error: err.Error()})
+		return true
+	}
+	backoff := jobBaseBackoff << (job.Attempts - 1)
+	if backoff > jobMaxBackoff {
+		backoff = jobMaxBackoff
+	}
+	if err := cfg.db.RetryJob(job.ID, err.Error(), time.Now().UTC().Add(backoff)); err != nil {
+		log.Printf("Couldn't reschedule job %s: %v", job.ID, err)
+	}
+	publish(videoEvent{Type: videoEventQueued, Error: err.Error()})
+	return true
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, job database.Job) error {
+	switch job.Kind {
+	case jobKindProcessVideo:
+		var payload processVideoPayload
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			return fmt.Errorf("%w: decode payload: %v", errPermanent, err)
+		}
+		return cfg.runProcessVideoJob(ctx, job.VideoID, payload)
+	case jobKindGenerateThumbnail:
+		var payload generateThumbnailPayload
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			return fmt.Errorf("%w: decode payload: %v", errPermanent, err)
+		}
+		return cfg.runGenerateThumbnailJob(ctx, job.VideoID, payload)
+	case jobKindCreateClip:
+		var payload createClipPayload
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			return fmt.Errorf("%w: decode payload: %v", errPermanent, err)
+		}
+		return cfg.runCreateClipJob(ctx, job.VideoID, payload)
+	default:
+		return fmt.Errorf("%w: unknown job kind %q", errPermanent, job.Kind)
+	}
+}
+
+func (cfg *apiConfig) runProcessVideoJob(ctx context.Context, videoID uuid.UUID, payload processVideoPayload) error {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("%w: video %s no longer exists", errPermanent, videoID)
+	}
+
+	rawPath, err := cfg.downloadObject(ctx, payload.RawKey)
+	if errors.Is(err, errObjectNotFound) {
+		return fmt.Errorf("%w: raw upload %s is missing", errPermanent, payload.RawKey)
+	}
+	if err != nil {
+		return fmt.Errorf("download raw upload: %w", err)
+	}
+	defer os.Remove(rawPath)
+
+	previous := cfg.snapshotOutputs(ctx, video)
+	video.MediaKind = mediaKindOf(payload.MediaType)
+	video, err = cfg.processAndStoreVideo(ctx, video, rawPath, cfg.newProcessingProgress(video))
+	if err != nil {
+		return err
+	}
+	cfg.scheduleDeletion(ctx, database.DeletionKindObject, payload.RawKey)
+	cfg.deleteStaleOutputs(ctx, previous, video)
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "sync"
+
+// keyedMutex is a lock per key: upload sessions use it so two PATCHes can't
+// write at the same offset, direct uploads so a key is only queued once,
+// and the asset handler so a variant is only rendered once. Keys come from requests, so an entry is reference counted
+// and removed once nobody holds or waits for it; the map only ever has the
+// keys in flight.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyedLock{}}
+}
+
+// Lock blocks until key is free and returns the func that frees it.
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Loudness normalization is ffmpeg's loudnorm filter run twice: a first
+// pass measures the audio against EBU R128, and a second applies a single
+// gain computed from that measurement, which keeps the original dynamics
+// where a one-pass run would compress them. Only the audio is re-encoded;
+// the video stream is copied.
+
+type loudnessOptions struct {
+	// target is the integrated loudness to normalize to, in LUFS.
+	target float64
+	// truePeak is the ceiling in dBTP.
+	truePeak float64
+	// lra is the loudness range target in LU.
+	lra float64
+}
+
+// validateLoudnessOptions checks the options are within what loudnorm
+// accepts.
+func validateLoudnessOptions(opts loudnessOptions) error {
+	if opts.target < -70 || opts.target > -5 {
+		return fmt.Errorf("target must be between -70 and -5 LUFS")
+	}
+	if opts.truePeak < -9 || opts.truePeak > 0 {
+		return fmt.Errorf("true peak must be between -9 and 0 dBTP")
+	}
+	if opts.lra < 1 || opts.lra > 20 {
+		return fmt.Errorf("loudness range must be between 1 and 20 LU")
+	}
+	return nil
+}
+
+func (opts loudnessOptions) filter() string {
+	return fmt.Sprintf("loudnorm=I=%s:TP=%s:LRA=%s",
+		strconv.FormatFloat(opts.target, 'f', -1, 64),
+		strconv.FormatFloat(opts.truePeak, 'f', -1, 64),
+		strconv.FormatFloat(opts.lra, 'f', -1, 64))
+}
+
+// loudnessMeasurement is loudnorm's first-pass report. It prints every
+// value as a string, and "-inf" for silence.
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// errSilentAudio means there's nothing to normalize.
+var errSilentAudio = errors.New("audio is silent")
+
+// measureLoudness runs loudnorm's analysis pass over the first audio
+// stream of input.
+func (cfg *apiConfig) measureLoudness(ctx context.Context, input string) (loudnessMeasurement, error) {
+	var log bytes.Buffer
+	err := cfg.transcoder.Transcode(withTranscodeLog(ctx, &log),
+		"-i", input,
+		"-map", "0:a:0",
+		"-af", cfg.processing.loudness.filter()+":print_format=json",
+		"-f", "null",
+		os.DevNull,
+	)
+	if err != nil {
+		return loudnessMeasurement{}, err
+	}
+	// The report is the last JSON object in the log.
+	report := log.String()
+	start, end := strings.LastIndex(report, "{"), strings.LastIndex(report, "}")
+	if start < 0 || end < start {
+		return loudnessMeasurement{}, fmt.Errorf("loudnorm printed no measurement")
+	}
+	var m loudnessMeasurement
+	if err := json.Unmarshal([]byte(report[start:end+1]), &m); err != nil {
+		return loudnessMeasurement{}, fmt.Errorf("decode loudnorm measurement: %w", err)
+	}
+	for _, value := range []string{m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset} {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(v, 0) {
+			return loudnessMeasurement{}, errSilentAudio
+		}
+	}
+	return m, nil
+}
+
+// applyLoudnorm writes a copy of filePath with its audio normalized using
+// the first-pass measurement m. The video stream, if any, is copied.
+func (cfg *apiConfig) applyLoudnorm(ctx context.Context, filePath string, m loudnessMeasurement, sampleRate string) (string, error) {
+	filter := fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		cfg.processing.loudness.filter(), m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset)
+	if sampleRate == "" {
+		sampleRate = "48000"
+	}
+	output := filePath + ".loudnorm"
+	err := cfg.transcoder.Transcode(ctx,
+		"-i", filePath,
+		"-map", "0:v:0?",
+		"-map", "0:a:0",
+		"-c:v", "copy",
+		"-af", filter,
+		// loudnorm resamples to 192kHz internally; go back to the source rate.
+		"-ar", sampleRate,
+		"-c:a", "aac",
+		"-b:a", "192k",
+		"-movflags", "faststart",
+		"-f", "mp4",
+		output,
+	)
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+	return output, nil
+}
+
+// loudnessResult is what runLoudnessStage records in the video's metadata.
+type loudnessResult struct {
+	integrated float64
+	lra        float64
+	truePeak   float64
+	target     float64
+}
+
+// runLoudnessStage normalizes the loudness of the processed file at
+// filePath when the deployment asks for it. It returns the path to use from
+// here on, which the caller removes when it differs from filePath, and the
+// measurement, or nil if nothing was done. Clips keep their source's
+// levels, and files without audio or with only silence are left alone.
+func (cfg *apiConfig) runLoudnessStage(ctx context.Context, video database.Video, filePath string, progress *processingProgress) (string, *loudnessResult, error) {
+	if !cfg.processing.loudnessEnabled || video.SourceVideoID != nil {
+		return filePath, nil, nil
+	}
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	audio, ok := probe.firstStream("audio")
+	if !ok {
+		return filePath, nil, nil
+	}
+
+	m, err := cfg.measureLoudness(progress.stage(ctx, stageLoudnessScan), filePath)
+	if errors.Is(err, errSilentAudio) {
+		return filePath, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("measure loudness: %w", err)
+	}
+	output, err := cfg.applyLoudnorm(progress.stage(ctx, stageLoudness), filePath, m, audio.SampleRate)
+	if err != nil {
+		return "", nil, err
+	}
+	// measureLoudness has checked these all parse.
+	result := &loudnessResult{target: cfg.processing.loudness.target}
+	result.integrated, _ = strconv.ParseFloat(m.InputI, 64)
+	result.lra, _ = strconv.ParseFloat(m.InputLRA, 64)
+	result.truePeak, _ = strconv.ParseFloat(m.InputTP, 64)
+	return output, result, nil
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -24,7 +28,24 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client         *s3.Client
+	objectStore      ObjectStore
+	urlSigner        URLSigner
+
+	uploadSessionsRoot string
+	uploadSessionLocks *keyedMutex
+	// directUploadLocks serialises completes of the same uploaded key.
+	directUploadLocks *keyedMutex
+
+	prober     MediaProber
+	transcoder Transcoder
+	jobs       *jobQueue
+	processing processingConfig
+	events     *videoEventHub
+	admission  admissionConfig
+
+	assetResize     assetResizeConfig
+	assetCache      *assetCache
+	assetCacheLocks *keyedMutex
 }
 
 func main() {
@@ -60,30 +81,216 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	objectStoreKind := os.Getenv("OBJECT_STORE")
+	if objectStoreKind == "" {
+		objectStoreKind = "s3"
+	}
+	// Presigned URLs of the disk and memory stores get their own key, so a
+	// leaked one can't be used to mint JWTs or the other way round.
+	objectStoreSigningKey := os.Getenv("OBJECT_STORE_SIGNING_KEY")
+	if objectStoreKind != "s3" && objectStoreSigningKey == "" {
+		log.Fatal("OBJECT_STORE_SIGNING_KEY environment variable is not set")
+	}
+	if objectStoreSigningKey == jwtSecret {
+		log.Fatal("OBJECT_STORE_SIGNING_KEY must differ from JWT_SECRET")
 	}
+	storeConfig := objectStoreConfig{
+		diskRoot: os.Getenv("OBJECT_STORE_ROOT"),
+		signer: localURLSigner{
+			baseURL: fmt.Sprintf("http://localhost:%s", port),
+			secret:  []byte(objectStoreSigningKey),
+		},
+	}
+
+	var s3Bucket, s3Region, s3CfDistribution string
+	if objectStoreKind == "s3" {
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+		awsConfig, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			log.Fatal("AWS Config can't be set")
+		}
+		storeConfig.s3Client = s3.NewFromConfig(awsConfig)
+		storeConfig.s3Bucket = s3Bucket
+		storeConfig.s3Multipart = multipartOptions{
+			partSize:    int64(getEnvInt("S3_MULTIPART_PART_SIZE_MB", 8)) << 20,
+			concurrency: getEnvInt("S3_MULTIPART_CONCURRENCY", 4),
+		}
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	objectStore, err := newObjectStore(objectStoreKind, storeConfig)
+	if err != nil {
+		log.Fatalf("Couldn't create object store: %v", err)
 	}
-	awsConfig, err := config.LoadDefaultConfig(context.Background())
+
+	var urlSigner URLSigner = storeURLSigner{store: objectStore}
+	switch os.Getenv("VIDEO_URL_SIGNER") {
+	case "", "store":
+	case "cloudfront":
+		if objectStoreKind != "s3" {
+			log.Fatal("VIDEO_URL_SIGNER=cloudfront requires OBJECT_STORE=s3")
+		}
+		urlSigner, err = newCloudFrontSigner(cloudFrontConfig{
+			domain:         s3CfDistribution,
+			keyPairID:      os.Getenv("CF_KEY_PAIR_ID"),
+			privateKeyPath: os.Getenv("CF_PRIVATE_KEY_PATH"),
+			customPolicy:   os.Getenv("CF_POLICY") == "custom",
+			cookieDomain:   os.Getenv("CF_COOKIE_DOMAIN"),
+		})
+		if err != nil {
+			log.Fatalf("Couldn't create CloudFront signer: %v", err)
+		}
+	default:
+		log.Fatal("VIDEO_URL_SIGNER must be store or cloudfront")
+	}
+
+	scratchDir := os.Getenv("SCRATCH_DIR")
+	if scratchDir == "" {
+		scratchDir = os.TempDir()
+	}
+	err = os.MkdirAll(scratchDir, 0755)
 	if err != nil {
-		log.Fatal("AWS Config can't be set")
+		log.Fatalf("Couldn't create scratch directory: %v", err)
+	}
+	processingConcurrency := getEnvInt("PROCESSING_CONCURRENCY", runtime.NumCPU())
+	uploadConcurrency := getEnvInt("UPLOAD_CONCURRENCY", 4)
+	if processingConcurrency <= 0 || uploadConcurrency <= 0 {
+		log.Fatal("PROCESSING_CONCURRENCY and UPLOAD_CONCURRENCY must be positive")
 	}
 
+	uploadSessionsRoot := os.Getenv("UPLOAD_SESSIONS_ROOT")
+	if uploadSessionsRoot == "" {
+		uploadSessionsRoot = filepath.Join(scratchDir, "tubely-upload-sessions")
+	}
+	err = os.MkdirAll(uploadSessionsRoot, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create upload sessions directory: %v", err)
+	}
+
+	thumbnailMode := os.Getenv("THUMBNAIL_MODE")
+	switch thumbnailMode {
+	case "":
+		thumbnailMode = thumbnailModeTimestamp
+	case thumbnailModeTimestamp, thumbnailModeScene:
+	default:
+		log.Fatal("THUMBNAIL_MODE must be timestamp or scene")
+	}
+
+	aspectRatio, err := newAspectRatioConfig(
+		getEnvFloat("ASPECT_RATIO_TOLERANCE", 0.02),
+		getEnvMap("ASPECT_RATIO_PREFIXES"),
+	)
+	if err != nil {
+		log.Fatalf("Invalid aspect ratio settings: %v", err)
+	}
+
+	videoTypes := getEnvList("VIDEO_ALLOWED_TYPES", []string{
+		"video/mp4",
+		"video/webm",
+		"video/quicktime",
+		"video/x-matroska",
+		"video/x-msvideo",
+	})
+	err = validateMediaTypes(videoTypes, videoContainerExts)
+	if err != nil {
+		log.Fatalf("Invalid VIDEO_ALLOWED_TYPES: %v", err)
+	}
+	loudness := loudnessOptions{
+		target:   getEnvFloat("LOUDNORM_TARGET_LUFS", -23),
+		truePeak: getEnvFloat("LOUDNORM_TRUE_PEAK", -1),
+		lra:      getEnvFloat("LOUDNORM_LRA", 11),
+	}
+	if err := validateLoudnessOptions(loudness); err != nil {
+		log.Fatalf("Invalid loudness settings: %v", err)
+	}
+	waveformPoints := getEnvInt("WAVEFORM_POINTS", 1000)
+	if waveformPoints <= 0 {
+		log.Fatal("WAVEFORM_POINTS must be positive")
+	}
+	audioTypes := getEnvList("AUDIO_ALLOWED_TYPES", []string{
+		"audio/mpeg",
+		"audio/aac",
+		"audio/mp4",
+		"audio/wav",
+		"audio/flac",
+	})
+	err = validateMediaTypes(audioTypes, audioContainerExts)
+	if err != nil {
+		log.Fatalf("Invalid AUDIO_ALLOWED_TYPES: %v", err)
+	}
+
+	assetCacheDir := os.Getenv("ASSET_CACHE_DIR")
+	if assetCacheDir == "" {
+		assetCacheDir = filepath.Join(os.TempDir(), "tubely-asset-cache")
+	}
+	assetCache, err := newAssetCache(assetCacheDir, int64(getEnvInt("ASSET_CACHE_MAX_MB", 256))<<20)
+	if err != nil {
+		log.Fatalf("Couldn't create asset cache: %v", err)
+	}
+
+	storyboard := storyboardOptions{
+		interval:  getEnvDuration("STORYBOARD_INTERVAL", 5*time.Second),
+		tileWidth: getEnvInt("STORYBOARD_TILE_WIDTH", 160),
+		columns:   getEnvInt("STORYBOARD_COLUMNS", 5),
+		rows:      getEnvInt("STORYBOARD_ROWS", 5),
+	}
+	if storyboard.interval <= 0 || storyboard.tileWidth <= 0 || storyboard.columns <= 0 || storyboard.rows <= 0 {
+		log.Fatal("STORYBOARD_INTERVAL, STORYBOARD_TILE_WIDTH, STORYBOARD_COLUMNS and STORYBOARD_ROWS must be positive")
+	}
+
+	watermarkPosition := os.Getenv("WATERMARK_POSITION")
+	if watermarkPosition == "" {
+		watermarkPosition = "bottom-right"
+	}
+	watermark := watermarkOptions{
+		key:      os.Getenv("WATERMARK_KEY"),
+		position: watermarkPosition,
+		opacity:  getEnvFloat("WATERMARK_OPACITY", 0.8),
+		scale:    getEnvFloat("WATERMARK_SCALE", 0.15),
+	}
+	err = validateWatermarkSettings(watermark.position, watermark.opacity, watermark.scale)
+	if err != nil {
+		log.Fatalf("Invalid watermark settings: %v", err)
+	}
+
+	var prober MediaProber
+	var transcoder Transcoder
+	switch os.Getenv("MEDIA_TOOLS") {
+	case "", "ffmpeg":
+		tools := ffmpegTools{
+			ffmpegPath:       "ffmpeg",
+			ffprobePath:      "ffprobe",
+			probeTimeout:     getEnvDuration("FFPROBE_TIMEOUT", 30*time.Second),
+			transcodeTimeout: getEnvDuration("FFMPEG_TIMEOUT", 0),
+		}
+		prober, transcoder = tools, tools
+	case "fake":
+		tools := newFakeMediaTools()
+		prober, transcoder = tools, tools
+	default:
+		log.Fatal("MEDIA_TOOLS must be ffmpeg or fake")
+	}
+	transcoder = newLimitedTranscoder(transcoder, processingConcurrency)
+
+	events := newVideoEventHub()
 	cfg := apiConfig{
 		db:               db,
 		jwtSecret:        jwtSecret,
@@ -94,7 +301,50 @@ func main() {
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		port:             port,
-		s3Client:         s3.NewFromConfig(awsConfig),
+		objectStore:      objectStore,
+		urlSigner:        urlSigner,
+
+		uploadSessionsRoot: uploadSessionsRoot,
+		uploadSessionLocks: newKeyedMutex(),
+		directUploadLocks:  newKeyedMutex(),
+
+		prober:     prober,
+		transcoder: transcoder,
+		jobs:       newJobQueue(db, getEnvDuration("PROCESSING_JOB_TIMEOUT", 2*time.Hour), events),
+		events:     events,
+		admission: admissionConfig{
+			scratchDir:   scratchDir,
+			minFreeBytes: int64(getEnvInt("SCRATCH_MIN_FREE_MB", 1024)) << 20,
+			uploadSlots:  make(chan struct{}, uploadConcurrency),
+			retryAfter:   getEnvDuration("BUSY_RETRY_AFTER", 30*time.Second),
+		},
+		processing: processingConfig{
+			hlsEnabled:    getEnvBool("HLS_ENABLED", false),
+			dashEnabled:   getEnvBool("DASH_ENABLED", false),
+			hlsRenditions: getEnvIntList("HLS_RENDITIONS", []int{1080, 720, 480, 360}),
+			thumbnail: thumbnailOptions{
+				mode: thumbnailMode,
+				at:   getEnvDuration("THUMBNAIL_TIMESTAMP", 2*time.Second),
+			},
+			thumbnailWidths:   getEnvIntList("THUMBNAIL_WIDTHS", []int{160, 320, 640, 1280}),
+			aspectRatio:       aspectRatio,
+			videoTypes:        videoTypes,
+			audioTypes:        audioTypes,
+			storyboardEnabled: getEnvBool("STORYBOARD_ENABLED", false),
+			storyboard:        storyboard,
+			watermark:         watermark,
+			clipMaxDuration:   getEnvDuration("CLIP_MAX_DURATION", 10*time.Minute),
+			waveformPoints:    waveformPoints,
+			loudnessEnabled:   getEnvBool("LOUDNORM_ENABLED", false),
+			loudness:          loudness,
+		},
+
+		assetResize: assetResizeConfig{
+			widths:  getEnvIntList("ASSET_RESIZE_WIDTHS", []int{160, 320, 640, 1280}),
+			heights: getEnvIntList("ASSET_RESIZE_HEIGHTS", []int{90, 180, 360, 720}),
+		},
+		assetCache:      assetCache,
+		assetCacheLocks: newKeyedMutex(),
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -102,25 +352,73 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	go func() {
+		for range time.Tick(time.Hour) {
+			cfg.cleanupExpiredUploadSessions()
+		}
+	}()
+
+	cfg.startJobWorkers(getEnvInt("PROCESSING_WORKERS", 2))
+
+	if s3Store, ok := objectStore.(*s3ObjectStore); ok {
+		go func() {
+			err := s3Store.abortStaleMultipartUploads(context.Background(), cfg.managedObjectPrefixes(), 24*time.Hour)
+			if err != nil {
+				log.Printf("Couldn't clean up stale multipart uploads: %v", err)
+			}
+		}()
+	}
+
+	cfg.runStorageCleanup(
+		time.Minute,
+		getEnvDuration("ORPHAN_SWEEP_INTERVAL", 0),
+		getEnvDuration("ORPHAN_GRACE_PERIOD", 24*time.Hour),
+	)
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	mux.HandleFunc("GET /assets/{name}", cfg.handlerAsset)
+
+	mux.HandleFunc("GET /objects/{key...}", cfg.handlerObjectGet)
+	mux.HandleFunc("PUT /objects/{key...}", cfg.handlerObjectPut)
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("GET /api/users/watermark", cfg.handlerWatermarkGet)
+	mux.HandleFunc("POST /api/users/watermark", cfg.handlerWatermarkUpload)
+	mux.HandleFunc("DELETE /api/users/watermark", cfg.handlerWatermarkDelete)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/regenerate", cfg.handlerThumbnailRegenerate)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerUploadVideoPresign)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.handlerUploadVideoComplete)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/sessions", cfg.handlerUploadSessionCreate)
+	mux.HandleFunc("HEAD /api/video_upload/{videoID}/sessions/{sessionID}", cfg.handlerUploadSessionHead)
+	mux.HandleFunc("PATCH /api/video_upload/{videoID}/sessions/{sessionID}", cfg.handlerUploadSessionPatch)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/sessions/{sessionID}/finalize", cfg.handlerUploadSessionFinalize)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/cookies", cfg.handlerVideoCookies)
+	mux.HandleFunc("GET /api/videos/{videoID}/processing", cfg.handlerVideoProcessingStatus)
+	mux.HandleFunc("GET /api/videos/{videoID}/events", cfg.handlerVideoEvents)
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/{path...}", cfg.handlerVideoHLSPlaylist)
+	mux.HandleFunc("GET /api/videos/{videoID}/dash/{path...}", cfg.handlerVideoDASH)
+	mux.HandleFunc("GET /api/videos/{videoID}/storyboard/{path...}", cfg.handlerVideoStoryboard)
+	mux.HandleFunc("POST /api/videos/{videoID}/clips", cfg.handlerVideoClipCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions", cfg.handlerCaptionsList)
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerCaptionsCreate)
+	mux.HandleFunc("PUT /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionsReplace)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionsDelete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoMetadataFromProbe flattens an ffprobe result into the columns we
+// keep. Values ffprobe couldn't determine are left at zero, as are the
+// video columns of audio-only files.
+func videoMetadataFromProbe(videoID uuid.UUID, probe ffprobeOutput) (database.VideoMetadata, error) {
+	metadata := database.VideoMetadata{
+		VideoID:   videoID,
+		ProbedAt:  time.Now().UTC(),
+		Container: probe.Format.FormatName,
+	}
+	video, hasVideo := probe.firstStream("video")
+	if _, hasAudio := probe.firstStream("audio"); !hasVideo && !hasAudio {
+		return database.VideoMetadata{}, fmt.Errorf("no video or audio stream")
+	}
+	if hasVideo {
+		metadata.VideoCodec = video.CodecName
+		metadata.Width = video.Width
+		metadata.Height = video.Height
+		metadata.FrameRate = video.frameRate()
+		metadata.Rotation = video.rotation()
+		metadata.PixelFormat = video.PixFmt
+	}
+	metadata.DurationSeconds, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	metadata.SizeBytes, _ = strconv.ParseInt(probe.Format.Size, 10, 64)
+	metadata.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	// "mov,mp4,m4a,3gp,3g2,mj2" is one demuxer; the first name is enough.
+	metadata.Container, _, _ = strings.Cut(metadata.Container, ",")
+
+	if audio, ok := probe.firstStream("audio"); ok {
+		codec := audio.CodecName
+		channels := audio.Channels
+		metadata.AudioCodec = &codec
+		metadata.AudioChannels = &channels
+		if rate, err := strconv.Atoi(audio.SampleRate); err == nil {
+			metadata.AudioSampleRate = &rate
+		}
+	}
+	return metadata, nil
+}
+
+// storeVideoMetadata probes the processed file and saves the result along
+// with loudness, the normalization measurement if there was one. Like
+// the thumbnail step, a failure is logged rather than failing the upload.
+func (cfg *apiConfig) storeVideoMetadata(ctx context.Context, videoID uuid.UUID, filePath string, loudness *loudnessResult) {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		log.Printf("Couldn't probe video %s: %v", videoID, err)
+		return
+	}
+	metadata, err := videoMetadataFromProbe(videoID, probe)
+	if err != nil {
+		log.Printf("Couldn't read metadata for video %s: %v", videoID, err)
+		return
+	}
+	if loudness != nil {
+		metadata.LoudnessIntegrated = &loudness.integrated
+		metadata.LoudnessRange = &loudness.lra
+		metadata.LoudnessTruePeak = &loudness.truePeak
+		metadata.LoudnessTarget = &loudness.target
+	}
+	if err := cfg.db.UpsertVideoMetadata(metadata); err != nil {
+		log.Printf("Couldn't store metadata for video %s: %v", videoID, err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// fakeMediaTools stands in for ffmpeg and ffprobe, so the server and its
+// handlers can run without either installed. Probe returns canned output
+// and Transcode records its arguments and writes a placeholder output
+// file.
+type fakeMediaTools struct {
+	mu           sync.Mutex
+	probes       map[string]ffprobeOutput
+	defaultProbe ffprobeOutput
+	probeErr     error
+	transcodeErr error
+	calls        [][]string
+}
+
+// newFakeMediaTools probes every input as a ten second 1280x720 H.264 MP4
+// with stereo AAC audio.
+func newFakeMediaTools() *fakeMediaTools {
+	return &fakeMediaTools{
+		probes: map[string]ffprobeOutput{},
+		defaultProbe: ffprobeOutput{
+			Streams: []ffprobeStream{
+				{Index: 0, CodecType: "video", CodecName: "h264", Width: 1280, Height: 720, PixFmt: "yuv420p", AvgFrameRate: "30/1"},
+				{Index: 1, CodecType: "audio", CodecName: "aac", Channels: 2, SampleRate: "48000"},
+			},
+			Format: ffprobeFormat{FormatName: "mov,mp4,m4a,3gp,3g2,mj2", Duration: "10.000000"},
+		},
+	}
+}
+
+// setProbe makes Probe return probe for input.
+func (f *fakeMediaTools) setProbe(input string, probe ffprobeOutput) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probes[input] = probe
+}
+
+// transcodeCalls returns the arguments of every Transcode call so far.
+func (f *fakeMediaTools) transcodeCalls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := make([][]string, len(f.calls))
+	for i, call := range f.calls {
+		calls[i] = slices.Clone(call)
+	}
+	return calls
+}
+
+func (f *fakeMediaTools) Probe(ctx context.Context, input string) (ffprobeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.probeErr != nil {
+		return ffprobeOutput{}, f.probeErr
+	}
+	if probe, ok := f.probes[input]; ok {
+		return probe, nil
+	}
+	return f.defaultProbe, nil
+}
+
+// Transcode writes a placeholder at the output path, the last argument: a
+// small JPEG for .jpg outputs, since thumbnails get decoded, and an empty
+// file otherwise. Patterned outputs such as HLS's %v are left alone. A
+// progress listener on ctx is told the run finished, and a log listener
+// gets a loudnorm report when the run is a loudness measurement.
+func (f *fakeMediaTools) Transcode(ctx context.Context, args ...string) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, slices.Clone(args))
+	err := f.transcodeErr
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := f.writePlaceholder(args); err != nil {
+		return err
+	}
+	if w := transcodeLogWriter(ctx); w != nil && slices.ContainsFunc(args, func(arg string) bool {
+		return strings.Contains(arg, "print_format=json")
+	}) {
+		if _, err := io.WriteString(w, fakeLoudnessReport); err != nil {
+			return err
+		}
+	}
+	if fn := transcodeProgressFunc(ctx); fn != nil {
+		fn(transcodeProgress{Done: true})
+	}
+	return nil
+}
+
+// fakeLoudnessReport is what loudnorm prints at the end of its analysis.
+const fakeLoudnessReport = `[Parsed_loudnorm_0 @ 0x0]
+{
+	"input_i" : "-27.61",
+	"input_tp" : "-4.47",
+	"input_lra" : "18.06",
+	"input_thresh" : "-39.20",
+	"output_i" : "-23.05",
+	"output_tp" : "-1.00",
+	"output_lra" : "10.40",
+	"output_thresh" : "-34.08",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.05"
+}
+`
+
+func (f *fakeMediaTools) writePlaceholder(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	output := args[len(args)-1]
+	if strings.Contains(output, "%") || strings.Contains(output, "://") {
+		return nil
+	}
+	var data []byte
+	if strings.EqualFold(filepath.Ext(output), ".jpg") {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 9)), nil); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	return os.WriteFile(output, data, 0644)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffmpegTools runs the ffmpeg and ffprobe binaries. Each run is bounded by
+// its own timeout on top of whatever deadline the caller's context
+// carries, and killed when either expires.
+type ffmpegTools struct {
+	ffmpegPath       string
+	ffprobePath      string
+	probeTimeout     time.Duration
+	transcodeTimeout time.Duration
+}
+
+// mediaToolError is a failed ffmpeg or ffprobe run. Stderr holds the tail
+// of the tool's output, which is where it explains itself. Args aren't
+// part of the message since inputs are often presigned URLs.
+type mediaToolError struct {
+	Tool     string
+	Args     []string
+	ExitCode int // -1 if the process never ran or was killed
+	TimedOut bool
+	Stderr   string
+	Err      error
+}
+
+const mediaToolStderrTail = 1000
+
+func (e *mediaToolError) Error() string {
+	switch {
+	case e.TimedOut:
+		return fmt.Sprintf("%s timed out: %s", e.Tool, e.Stderr)
+	case e.ExitCode >= 0:
+		return fmt.Sprintf("%s exited with status %d: %s", e.Tool, e.ExitCode, e.Stderr)
+	default:
+		return fmt.Sprintf("%s: %v", e.Tool, e.Err)
+	}
+}
+
+func (e *mediaToolError) Unwrap() error {
+	return e.Err
+}
+
+func (t ffmpegTools) Probe(ctx context.Context, input string) (ffprobeOutput, error) {
+	var output bytes.Buffer
+	err := t.run(ctx, t.probeTimeout, &output, nil, t.ffprobePath, "-v", "error", "-print_format", "json", "-show_streams", "-show_format", input)
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output.Bytes(), &probe); err != nil {
+		return ffprobeOutput{}, fmt.Errorf("decode ffprobe output: %w", err)
+	}
+	return probe, nil
+}
+
+// Transcode reports progress when ctx asks for it, by having ffmpeg write
+// its -progress key=value blocks to stdout, and copies its log to ctx's log
+// writer if there is one.
+func (t ffmpegTools) Transcode(ctx context.Context, args ...string) error {
+	args = append([]string{"-hide_banner", "-y"}, args...)
+	var stdout io.Writer = io.Discard
+	if fn := transcodeProgressFunc(ctx); fn != nil {
+		args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+		stdout = &ffmpegProgressWriter{report: fn}
+	}
+	return t.run(ctx, t.transcodeTimeout, stdout, transcodeLogWriter(ctx), t.ffmpegPath, args...)
+}
+
+// run runs name with its stdout going to stdout and its stderr, if log
+// isn't nil, copied to log. A zero timeout leaves the limit to ctx.
+func (t ffmpegTools) run(ctx context.Context, timeout time.Duration, stdout, log io.Writer, name string, args ...string) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if log != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, log)
+	}
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	toolErr := &mediaToolError{
+		Tool:     name,
+		Args:     args,
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Err:      err,
+	}
+	if len(toolErr.Stderr) > mediaToolStderrTail {
+		toolErr.Stderr = "..." + toolErr.Stderr[len(toolErr.Stderr)-mediaToolStderrTail:]
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		toolErr.TimedOut = errors.Is(ctxErr, context.DeadlineExceeded)
+		toolErr.Err = ctxErr
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		toolErr.ExitCode = exitErr.ExitCode()
+	}
+	return toolErr
+}
+
+// ffmpegProgressWriter parses ffmpeg's -progress output, blocks of
+// key=value lines that each end with a "progress=continue" or
+// "progress=end" line, and reports each block.
+type ffmpegProgressWriter struct {
+	report  func(transcodeProgress)
+	partial []byte
+	current transcodeProgress
+}
+
+func (w *ffmpegProgressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.parseLine(strings.TrimSpace(string(w.partial[:i])))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *ffmpegProgressWriter) parseLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+	switch key {
+	// Despite its name, out_time_ms is in microseconds too.
+	case "out_time_us", "out_time_ms":
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			w.current.OutTime = time.Duration(us) * time.Microsecond
+		}
+	case "speed":
+		speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64)
+		if err == nil {
+			w.current.Speed = speed
+		}
+	case "progress":
+		w.current.Done = value == "end"
+		w.report(w.current)
+	}
+}
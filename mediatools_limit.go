@@ -0,0 +1,25 @@
+package main
+
+import "context"
+
+// limitedTranscoder caps how many ffmpeg runs happen at once across job
+// workers and request handlers. Callers wait their turn, or give up when
+// their context ends.
+type limitedTranscoder struct {
+	Transcoder
+	slots chan struct{}
+}
+
+func newLimitedTranscoder(t Transcoder, n int) limitedTranscoder {
+	return limitedTranscoder{Transcoder: t, slots: make(chan struct{}, n)}
+}
+
+func (t limitedTranscoder) Transcode(ctx context.Context, args ...string) error {
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-t.slots }()
+	return t.Transcoder.Transcode(ctx, args...)
+}
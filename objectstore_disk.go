@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// diskObjectStore keeps objects as plain files under root, using the key as
+// the relative path. Content types are derived from the file extension.
+type diskObjectStore struct {
+	root   string
+	signer localURLSigner
+}
+
+func newDiskObjectStore(root string, signer localURLSigner) (*diskObjectStore, error) {
+	if root == "" {
+		return nil, errors.New("disk object store root is not set")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &diskObjectStore{root: root, signer: signer}, nil
+}
+
+func (s *diskObjectStore) path(key string) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *diskObjectStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write to a temp file and rename so readers never see a partial object.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *diskObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, ObjectInfo{}, diskError(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return f, diskObjectInfo(key, stat), nil
+}
+
+func (s *diskObjectStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *diskObjectStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, diskError(err)
+	}
+	if stat.IsDir() {
+		return ObjectInfo{}, errObjectNotFound
+	}
+	return diskObjectInfo(key, stat), nil
+}
+
+func (s *diskObjectStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, diskObjectInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *diskObjectStore) PresignGet(ctx context.Context, key string, expireTime time.Duration) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return s.signer.presign("GET", key, expireTime), nil
+}
+
+func (s *diskObjectStore) PresignPut(ctx context.Context, key, contentType string, expireTime time.Duration) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return s.signer.presign("PUT", key, expireTime), nil
+}
+
+func (s *diskObjectStore) urlSigner() localURLSigner {
+	return s.signer
+}
+
+func diskObjectInfo(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(key)),
+		LastModified: stat.ModTime(),
+	}
+}
+
+func diskError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return errObjectNotFound
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data        []byte
+	contentType string
+	modified    time.Time
+}
+
+// memoryObjectStore is a process-local store, useful for development and
+// for running the server without any external storage.
+type memoryObjectStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	signer  localURLSigner
+}
+
+func newMemoryObjectStore(signer localURLSigner) *memoryObjectStore {
+	return &memoryObjectStore{
+		objects: map[string]memoryObject{},
+		signer:  signer,
+	}
+}
+
+func (s *memoryObjectStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	if err := validateObjectKey(key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{
+		data:        data,
+		contentType: contentType,
+		modified:    time.Now().UTC(),
+	}
+	return nil
+}
+
+func (s *memoryObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	if err := validateObjectKey(key); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, ObjectInfo{}, errObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), obj.info(key), nil
+}
+
+func (s *memoryObjectStore) Delete(ctx context.Context, key string) error {
+	if err := validateObjectKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryObjectStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := validateObjectKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, errObjectNotFound
+	}
+	return obj.info(key), nil
+}
+
+func (s *memoryObjectStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	objects := []ObjectInfo{}
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info(key))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (s *memoryObjectStore) PresignGet(ctx context.Context, key string, expireTime time.Duration) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return s.signer.presign("GET", key, expireTime), nil
+}
+
+func (s *memoryObjectStore) PresignPut(ctx context.Context, key, contentType string, expireTime time.Duration) (string, error) {
+	if err := validateObjectKey(key); err != nil {
+		return "", err
+	}
+	return s.signer.presign("PUT", key, expireTime), nil
+}
+
+func (s *memoryObjectStore) urlSigner() localURLSigner {
+	return s.signer
+}
+
+func (o memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		ContentType:  o.contentType,
+		LastModified: o.modified,
+	}
+}
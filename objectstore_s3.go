@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type s3ObjectStore struct {
+	client    *s3.Client
+	presign   *s3.PresignClient
+	bucket    string
+	multipart multipartOptions
+}
+
+func newS3ObjectStore(client *s3.Client, bucket string, multipart multipartOptions) *s3ObjectStore {
+	return &s3ObjectStore{
+		client:    client,
+		presign:   s3.NewPresignClient(client),
+		bucket:    bucket,
+		multipart: multipart,
+	}
+}
+
+func (s *s3ObjectStore) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	return s.putMultipart(ctx, key, body, contentType)
+}
+
+func (s *s3ObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	info := ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+	}
+	return out.Body, info, nil
+}
+
+func (s *s3ObjectStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return s3Error(err)
+}
+
+func (s *s3ObjectStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *s3ObjectStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	objects := []ObjectInfo{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (s *s3ObjectStore) PresignGet(ctx context.Context, key string, expireTime time.Duration) (string, error) {
+	req, err := s.presign.PresignGetObject(ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		},
+		s3.WithPresignExpires(expireTime))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3ObjectStore) PresignPut(ctx context.Context, key, contentType string, expireTime time.Duration) (string, error) {
+	req, err := s.presign.PresignPutObject(ctx,
+		&s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String(contentType),
+		},
+		s3.WithPresignExpires(expireTime))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// PresignPost returns a browser form upload restricted by policy to the
+// given content type and at most maxSize bytes.
+func (s *s3ObjectStore) PresignPost(ctx context.Context, key, contentType string, maxSize int64, expireTime time.Duration) (PresignedPost, error) {
+	req, err := s.presign.PresignPostObject(ctx,
+		&s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String(contentType),
+		},
+		func(opts *s3.PresignPostOptions) {
+			opts.Expires = expireTime
+			opts.Conditions = []interface{}{
+				[]interface{}{"content-length-range", 1, maxSize},
+				map[string]string{"Content-Type": contentType},
+			}
+		})
+	if err != nil {
+		return PresignedPost{}, err
+	}
+	fields := req.Values
+	fields["Content-Type"] = contentType
+	return PresignedPost{URL: req.URL, Fields: fields}, nil
+}
+
+// s3Error maps the SDK's missing-object errors onto errObjectNotFound so
+// callers don't need to know which backend they are talking to.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return errObjectNotFound
+	}
+	return err
+}
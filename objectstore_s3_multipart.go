@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 rejects multipart parts smaller than 5MiB (except the last one).
+const minMultipartPartSize = 5 << 20
+
+type multipartOptions struct {
+	partSize    int64
+	concurrency int
+}
+
+func (o multipartOptions) normalized() multipartOptions {
+	if o.partSize < minMultipartPartSize {
+		o.partSize = minMultipartPartSize
+	}
+	if o.concurrency < 1 {
+		o.concurrency = 1
+	}
+	return o
+}
+
+// putMultipart streams body to key in partSize chunks, uploading up to
+// concurrency parts at once. Bodies that fit in a single part are sent with
+// a plain PutObject. If anything fails the multipart upload is aborted so S3
+// doesn't keep billing for the orphaned parts.
+func (s *s3ObjectStore) putMultipart(ctx context.Context, key string, body io.Reader, contentType string) error {
+	opts := s.multipart.normalized()
+
+	first, err := readPart(body, opts.partSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(first)) < opts.partSize {
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(first),
+			ContentType: aws.String(contentType),
+		})
+		return err
+	}
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	parts, err := s.uploadParts(ctx, key, uploadID, first, body, opts)
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return err
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (s *s3ObjectStore) uploadParts(ctx context.Context, key string, uploadID *string, first []byte, body io.Reader, opts multipartOptions) ([]types.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		parts    []types.CompletedPart
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	sem := make(chan struct{}, opts.concurrency)
+
+	data := first
+	for partNumber := int32(1); len(data) > 0; partNumber++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int32, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(s.bucket),
+				Key:        aws.String(key),
+				UploadId:   uploadID,
+				PartNumber: aws.Int32(partNumber),
+				Body:       bytes.NewReader(data),
+			})
+			if err != nil {
+				fail(fmt.Errorf("upload part %d: %w", partNumber, err))
+				return
+			}
+			mu.Lock()
+			parts = append(parts, types.CompletedPart{
+				ETag:       out.ETag,
+				PartNumber: aws.Int32(partNumber),
+			})
+			mu.Unlock()
+		}(partNumber, data)
+
+		var err error
+		data, err = readPart(body, opts.partSize)
+		if err != nil {
+			fail(err)
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	return parts, nil
+}
+
+func (s *s3ObjectStore) abortMultipart(key string, uploadID *string) {
+	// The request context may already be cancelled; cleanup must still run.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Couldn't abort multipart upload %s for %s: %v", aws.ToString(uploadID), key, err)
+	}
+}
+
+// abortStaleMultipartUploads cleans up multipart uploads left behind by a
+// crash mid-upload, which abortMultipart never got the chance to handle.
+// Only uploads under prefixes are considered, so other applications
+// sharing the bucket keep theirs.
+func (s *s3ObjectStore) abortStaleMultipartUploads(ctx context.Context, prefixes []string, olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	for _, prefix := range prefixes {
+		paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, upload := range page.Uploads {
+				if aws.ToTime(upload.Initiated).After(cutoff) {
+					continue
+				}
+				s.abortMultipart(aws.ToString(upload.Key), upload.UploadId)
+			}
+		}
+	}
+	return nil
+}
+
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return buf[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type processingConfig struct {
+	hlsEnabled    bool
+	dashEnabled   bool
+	hlsRenditions []int
+	thumbnail     thumbnailOptions
+	// thumbnailWidths are the sizes every thumbnail is resized to.
+	thumbnailWidths []int
+	aspectRatio     aspectRatioConfig
+	// videoTypes and audioTypes are the upload media types this deployment
+	// accepts.
+	videoTypes        []string
+	audioTypes        []string
+	storyboardEnabled bool
+	storyboard        storyboardOptions
+	// watermark is the deployment-wide logo; users can set their own.
+	watermark watermarkOptions
+	// clipMaxDuration caps how long a clip may be; 0 means no limit.
+	clipMaxDuration time.Duration
+	// waveformPoints is roughly how many min/max pairs an audio upload's
+	// waveform has.
+	waveformPoints  int
+	loudnessEnabled bool
+	loudness        loudnessOptions
+}
+
+// processAndStoreVideo runs the normalize/watermark/aspect-ratio pipeline on the raw
+// upload at rawPath, stores the result and records its key on the video.
+// Each stage reports into progress. Audio-only uploads go through
+// processAndStoreAudio instead.
+func (cfg *apiConfig) processAndStoreVideo(ctx context.Context, video database.Video, rawPath string, progress *processingProgress) (database.Video, error) {
+	if video.MediaKind == database.MediaKindAudio {
+		return cfg.processAndStoreAudio(ctx, video, rawPath, progress)
+	}
+	if probe, err := cfg.prober.Probe(ctx, rawPath); err == nil {
+		progress.setDuration(probe.duration())
+	}
+	processedVideoPath, err := cfg.normalizeVideo(progress.stage(ctx, stageNormalize), rawPath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("process video: %w", err)
+	}
+	defer os.Remove(processedVideoPath)
+
+	normalizedPath, loudness, err := cfg.runLoudnessStage(ctx, video, processedVideoPath, progress)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("loudness: %w", err)
+	}
+	if normalizedPath != processedVideoPath {
+		defer os.Remove(normalizedPath)
+		processedVideoPath = normalizedPath
+	}
+
+	watermarkedPath, err := cfg.runWatermarkStage(progress.stage(ctx, stageWatermark), video, processedVideoPath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("watermark: %w", err)
+	}
+	if watermarkedPath != processedVideoPath {
+		defer os.Remove(watermarkedPath)
+		processedVideoPath = watermarkedPath
+	}
+
+	ratio, err := cfg.getVideoAspectRatio(ctx, processedVideoPath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("get video ratio: %w", err)
+	}
+
+	prefix := videoKeyPrefix(ratio, video.ID)
+	key := getRandomAssetPathWithPrefix("video/mp4", prefix)
+	err = cfg.uploadVideoFile(ctx, key, processedVideoPath, "video/mp4")
+	if err != nil {
+		return database.Video{}, fmt.Errorf("upload video: %w", err)
+	}
+	progress.publish(videoEventUploaded)
+
+	videoURL := cfg.objectReference(key)
+	video.VideoURL = &videoURL
+
+	video.HLSURL = nil
+	video.DASHURL = nil
+	video.HLSStartPTS = nil
+	switch {
+	case cfg.processing.dashEnabled:
+		// One CMAF segment set backs both the DASH and the HLS manifest.
+		mpdKey, masterKey, err := cfg.runCMAFStage(progress.stage(ctx, stageStreams), processedVideoPath, prefix)
+		if err != nil {
+			return database.Video{}, fmt.Errorf("cmaf: %w", err)
+		}
+		dashURL := cfg.objectReference(mpdKey)
+		video.DASHURL = &dashURL
+		hlsURL := cfg.objectReference(masterKey)
+		video.HLSURL = &hlsURL
+	case cfg.processing.hlsEnabled:
+		masterKey, startPTS, err := cfg.runHLSStage(progress.stage(ctx, stageStreams), processedVideoPath, prefix)
+		if err != nil {
+			return database.Video{}, fmt.Errorf("hls: %w", err)
+		}
+		hlsURL := cfg.objectReference(masterKey)
+		video.HLSURL = &hlsURL
+		video.HLSStartPTS = startPTS
+	}
+
+	// Scrub previews are a nicety; a failure here shouldn't fail the upload.
+	video.StoryboardVTTURL = nil
+	if cfg.processing.storyboardEnabled {
+		vttKey, err := cfg.runStoryboardStage(progress.stage(ctx, stageStoryboard), processedVideoPath, prefix)
+		if err != nil {
+			log.Printf("Couldn't build storyboard for video %s: %v", video.ID, err)
+		} else {
+			vttURL := cfg.objectReference(vttKey)
+			video.StoryboardVTTURL = &vttURL
+		}
+	}
+
+	video, err = cfg.saveProcessingOutputs(video)
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	cfg.storeVideoMetadata(ctx, video.ID, processedVideoPath, loudness)
+	cfg.autoThumbnail(ctx, video.ID, processedVideoPath)
+	return video, nil
+}
+
+// saveProcessingOutputs records the pipeline's outputs on the video and
+// returns the row as it now stands. The video passed in was read when the
+// job started, so only the output columns are written from it.
+func (cfg *apiConfig) saveProcessingOutputs(video database.Video) (database.Video, error) {
+	if err := cfg.db.UpdateVideoProcessingOutputs(video); err != nil {
+		return database.Video{}, fmt.Errorf("update video: %w", err)
+	}
+	saved, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("get video: %w", err)
+	}
+	if saved.ID == uuid.Nil {
+		return database.Video{}, fmt.Errorf("%w: video %s no longer exists", errPermanent, video.ID)
+	}
+	return saved, nil
+}
+
+// objectReference is the "bucket,key" form stored in the videos table.
+func (cfg *apiConfig) objectReference(key string) string {
+	return fmt.Sprintf("%s,%s", cfg.s3Bucket, key)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	stageCut          = "cut"
+	stageNormalize    = "normalize"
+	stageLoudnessScan = "loudness_scan"
+	stageLoudness     = "loudness"
+	stageWatermark    = "watermark"
+	stageStreams      = "streams"
+	stageStoryboard   = "storyboard"
+	stageWaveform     = "waveform"
+
+	// progressInterval throttles progress events; ffmpeg reports about
+	// twice a second.
+	progressInterval = time.Second
+)
+
+type processingStage struct {
+	name string
+	// weight is the stage's rough share of the run's time.
+	weight float64
+}
+
+// processingProgress turns the ffmpeg progress of each pipeline stage into
+// an overall percentage and ETA on the video's event stream.
+type processingProgress struct {
+	events  *videoEventHub
+	videoID uuid.UUID
+	stages  []processingStage
+	started time.Time
+
+	mu       sync.Mutex
+	current  int // index into stages, -1 before the first
+	fraction float64
+	duration time.Duration
+	lastSent time.Time
+}
+
+// newProcessingProgress lays out the stages a video will go through. A
+// stage that turns out to have nothing to do, such as watermarking without
+// a logo, is simply skipped over.
+func (cfg *apiConfig) newProcessingProgress(video database.Video) *processingProgress {
+	var stages []processingStage
+	if video.SourceVideoID != nil {
+		stages = append(stages, processingStage{stageCut, 1})
+	}
+	stages = append(stages, processingStage{stageNormalize, 1})
+	if cfg.processing.loudnessEnabled && video.SourceVideoID == nil {
+		// Only the audio is decoded, and only it is re-encoded.
+		stages = append(stages, processingStage{stageLoudnessScan, 0.25}, processingStage{stageLoudness, 0.5})
+	}
+	if video.MediaKind == database.MediaKindAudio {
+		stages = append(stages, processingStage{stageWaveform, 1})
+	} else {
+		if video.SourceVideoID == nil {
+			stages = append(stages, processingStage{stageWatermark, 1})
+		}
+		if cfg.processing.hlsEnabled || cfg.processing.dashEnabled {
+			// Every rendition is a full encode.
+			stages = append(stages, processingStage{stageStreams, 2})
+		}
+		if cfg.processing.storyboardEnabled {
+			stages = append(stages, processingStage{stageStoryboard, 0.5})
+		}
+	}
+	return &processingProgress{
+		events:  cfg.events,
+		videoID: video.ID,
+		stages:  stages,
+		started: time.Now(),
+		current: -1,
+	}
+}
+
+// setDuration sets the length of the media the following stages work on,
+// which ffmpeg's position is measured against.
+func (p *processingProgress) setDuration(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.duration = d
+}
+
+// stage moves on to the named stage and returns a context whose Transcode
+// calls report into it.
+func (p *processingProgress) stage(ctx context.Context, name string) context.Context {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, stage := range p.stages {
+		if stage.name == name {
+			p.current = i
+			p.fraction = 0
+			p.publishLocked(videoEventProgress)
+			return withTranscodeProgress(ctx, p.report)
+		}
+	}
+	return ctx
+}
+
+// publish sends an event of the given type carrying the current progress.
+func (p *processingProgress) publish(eventType string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.publishLocked(eventType)
+}
+
+func (p *processingProgress) report(progress transcodeProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case progress.Done:
+		p.fraction = 1
+	case p.duration > 0:
+		p.fraction = min(float64(progress.OutTime)/float64(p.duration), 1)
+	}
+	if !progress.Done && time.Since(p.lastSent) < progressInterval {
+		return
+	}
+	p.publishLocked(videoEventProgress)
+}
+
+func (p *processingProgress) publishLocked(eventType string) {
+	event := videoEvent{Type: eventType, VideoID: p.videoID}
+	if p.current >= 0 {
+		var done, total float64
+		for i, stage := range p.stages {
+			total += stage.weight
+			if i < p.current {
+				done += stage.weight
+			}
+		}
+		done += p.stages[p.current].weight * p.fraction
+		overall := done / total
+
+		event.Stage = p.stages[p.current].name
+		percent := math.Round(overall*1000) / 10
+		event.Percent = &percent
+		if overall > 0 {
+			elapsed := time.Since(p.started).Seconds()
+			eta := math.Round(elapsed * (1 - overall) / overall)
+			event.ETASeconds = &eta
+		}
+	}
+	p.lastSent = time.Now()
+	p.events.publish(event)
+}
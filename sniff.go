@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Uploads are identified by their leading bytes rather than the
+// Content-Type the client sent, then checked more deeply: videos and audio
+// must be readable by ffprobe and images must decode.
+
+const (
+	sniffLen = 512
+	// maxImagePixels stops a tiny file that decodes to a huge bitmap.
+	maxImagePixels = 50_000_000
+)
+
+// errUnsupportedMedia is returned for uploads whose content doesn't match
+// what they claim to be, or that can't be read at all.
+var errUnsupportedMedia = errors.New("unsupported media")
+
+// sniffMediaType identifies header, the first bytes of a file, by its
+// signature. Unknown formats fall back to http.DetectContentType so error
+// messages can still say what the file looks like.
+func sniffMediaType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8, 0xff}):
+		return "image/jpeg"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "image/gif"
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return "image/webp"
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "AVI ":
+		return "video/x-msvideo"
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return "audio/wav"
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(header, []byte("ID3")):
+		// An ID3v2 tag is usually MP3, but can front raw AAC too.
+		return "audio/mpeg"
+	case len(header) >= 2 && header[0] == 0xff && header[1]&0xf6 == 0xf0:
+		// ADTS sync word with layer 0.
+		return "audio/aac"
+	case len(header) >= 2 && header[0] == 0xff && header[1]&0xe0 == 0xe0 && header[1]&0x06 != 0:
+		// MPEG audio frame sync with a layer set.
+		return "audio/mpeg"
+	case bytes.HasPrefix(header, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		// Both are EBML; the DocType element near the start tells them apart.
+		if bytes.Contains(header[:min(len(header), 64)], []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		switch string(header[8:12]) {
+		case "qt  ":
+			return "video/quicktime"
+		case "M4A ", "M4B ":
+			return "audio/mp4"
+		}
+		return "video/mp4"
+	case len(header) >= 8 && isQuickTimeAtom(string(header[4:8])):
+		// Older QuickTime files start straight with an atom, no ftyp.
+		return "video/quicktime"
+	}
+	mediaType, _, _ := strings.Cut(http.DetectContentType(header), ";")
+	return mediaType
+}
+
+func isQuickTimeAtom(name string) bool {
+	switch name {
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+// sameMediaFamily reports whether a file sniffed as sniffed can be trusted
+// as declared. MP4, M4A and QuickTime share a structure and are often
+// labelled either way, as are WebM and Matroska. ID3 tags front both MP3
+// and raw AAC.
+func sameMediaFamily(declared, sniffed string) bool {
+	if declared == sniffed {
+		return true
+	}
+	families := [][]string{
+		{"video/mp4", "video/quicktime", "audio/mp4"},
+		{"video/webm", "video/x-matroska"},
+		{"audio/mpeg", "audio/aac"},
+	}
+	for _, family := range families {
+		if slices.Contains(family, declared) && slices.Contains(family, sniffed) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSniffHeader reads up to sniffLen bytes from r.
+func readSniffHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// checkSignature compares the sniffed type of header with declared.
+func checkSignature(header []byte, declared string) error {
+	sniffed := sniffMediaType(header)
+	if !sameMediaFamily(declared, sniffed) {
+		return fmt.Errorf("%w: file content is %s, not %s", errUnsupportedMedia, sniffed, declared)
+	}
+	return nil
+}
+
+// validateImage checks that r holds a decodable image of the declared type
+// and rewinds it for the caller.
+func validateImage(r io.ReadSeeker, declared string) error {
+	header, err := readSniffHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := checkSignature(header, declared); err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("%w: image header can't be decoded: %v", errUnsupportedMedia, err)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return fmt.Errorf("%w: image is %dx%d, larger than %d pixels", errUnsupportedMedia, config.Width, config.Height, maxImagePixels)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, _, err := image.Decode(r); err != nil {
+		return fmt.Errorf("%w: image can't be decoded: %v", errUnsupportedMedia, err)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// validateVideo checks the signature in header against declared and that
+// ffprobe finds a playable video stream in input, a path or URL. Audio types
+// need an audio stream instead.
+func (cfg *apiConfig) validateVideo(ctx context.Context, input string, header []byte, declared string) error {
+	if err := checkSignature(header, declared); err != nil {
+		return err
+	}
+	probe, err := cfg.prober.Probe(ctx, input)
+	var execErr *exec.Error
+	if errors.As(err, &execErr) {
+		// ffprobe itself is missing; that's our problem, not the upload's.
+		return err
+	}
+	if err != nil {
+		// ffprobe's stderr may include the presigned URL, so only log it.
+		log.Printf("ffprobe rejected upload: %v", err)
+		return fmt.Errorf("%w: file isn't a readable video", errUnsupportedMedia)
+	}
+	kind := mediaKindOf(declared)
+	if kind == database.MediaKindAudio {
+		if _, ok := probe.firstStream("audio"); !ok {
+			return fmt.Errorf("%w: file has no audio stream", errUnsupportedMedia)
+		}
+	} else {
+		video, ok := probe.firstStream("video")
+		if !ok || video.Width <= 0 || video.Height <= 0 {
+			return fmt.Errorf("%w: file has no video stream", errUnsupportedMedia)
+		}
+	}
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err != nil || duration <= 0 {
+		return fmt.Errorf("%w: %s has no duration", errUnsupportedMedia, kind)
+	}
+	return nil
+}
+
+// validateVideoFile runs validateVideo on a local file.
+func (cfg *apiConfig) validateVideoFile(ctx context.Context, path, declared string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	header, err := readSniffHeader(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return cfg.validateVideo(ctx, path, header, declared)
+}
+
+// validateVideoObject runs validateVideo on a stored object, reading its
+// header directly and letting ffprobe fetch what it needs over a presigned
+// URL.
+func (cfg *apiConfig) validateVideoObject(ctx context.Context, key, declared string) error {
+	body, _, err := cfg.objectStore.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	header, err := readSniffHeader(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	url, err := cfg.objectStore.PresignGet(ctx, key, time.Hour)
+	if err != nil {
+		return err
+	}
+	return cfg.validateVideo(ctx, url, header, declared)
+}
+
+// respondWithValidationError sends 415 for errUnsupportedMedia, with the
+// reason, and 500 for anything else.
+func respondWithValidationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedMedia) {
+		respondWithError(w, http.StatusUnsupportedMediaType, err.Error(), err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Couldn't validate upload", err)
+}
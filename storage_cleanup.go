@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Stored files are never deleted inline. Each one is recorded in the
+// pending_deletions table first, so a failed delete (or a crash) is retried
+// by processPendingDeletions instead of leaking the file.
+
+const (
+	pendingDeletionBatchSize = 100
+	maxDeletionBackoff       = 24 * time.Hour
+)
+
+// videoStoragePrefixes returns the object key prefixes owned by a video.
+// Prefixes ending in "/" cover a whole directory; anything else is a single
+// key from before objects were grouped by video ID.
+func videoStoragePrefixes(videoID uuid.UUID, videoURL *string) []string {
+	prefixes := []string{directUploadPrefix(videoID), captionsPrefix(videoID)}
+	if videoURL == nil {
+		return prefixes
+	}
+	key, err := videoObjectKey(database.Video{VideoURL: videoURL})
+	if err != nil {
+		return prefixes
+	}
+	dir := path.Dir(key)
+	if path.Base(dir) == videoID.String() {
+		return append(prefixes, dir+"/")
+	}
+	return append(prefixes, key)
+}
+
+// assetPathFromURL maps a thumbnail URL served from /assets/ back to the
+// file name under assetsRoot.
+func (cfg *apiConfig) assetPathFromURL(assetURL *string) (string, bool) {
+	if assetURL == nil {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(*assetURL, cfg.getAssetURL(""))
+	if !ok || name == "" || name != filepath.Base(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// deleteVideoStorage queues every object and asset belonging to video.
+func (cfg *apiConfig) deleteVideoStorage(ctx context.Context, video database.Video) error {
+	for _, prefix := range videoStoragePrefixes(video.ID, video.VideoURL) {
+		if !strings.HasSuffix(prefix, "/") {
+			cfg.scheduleDeletion(ctx, database.DeletionKindObject, prefix)
+			continue
+		}
+		objects, err := cfg.objectStore.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, obj := range objects {
+			cfg.scheduleDeletion(ctx, database.DeletionKindObject, obj.Key)
+		}
+	}
+	for _, name := range cfg.thumbnailAssetNames(video.ThumbnailURL, video.Thumbnails) {
+		cfg.scheduleDeletion(ctx, database.DeletionKindAsset, name)
+	}
+	return nil
+}
+
+// previousOutputs is what a video had stored before it was reprocessed:
+// its processed file and, when outputs are grouped under the video's ID,
+// every object in that directory with its modification time.
+type previousOutputs struct {
+	key     string
+	dir     string
+	objects map[string]time.Time
+}
+
+// snapshotOutputs records video's stored outputs so deleteStaleOutputs can
+// tell which ones the next run left behind. If the directory can't be
+// listed only the processed file is cleaned up.
+func (cfg *apiConfig) snapshotOutputs(ctx context.Context, video database.Video) previousOutputs {
+	key, err := videoObjectKey(video)
+	if err != nil {
+		return previousOutputs{}
+	}
+	prev := previousOutputs{key: key}
+	dir := path.Dir(key)
+	if path.Base(dir) != video.ID.String() {
+		return prev
+	}
+	objects, err := cfg.objectStore.List(ctx, dir+"/")
+	if err != nil {
+		log.Printf("Couldn't list outputs of video %s: %v", video.ID, err)
+		return prev
+	}
+	prev.dir = dir
+	prev.objects = map[string]time.Time{}
+	for _, obj := range objects {
+		prev.objects[obj.Key] = obj.LastModified
+	}
+	return prev
+}
+
+// deleteStaleOutputs queues whatever of prev the run that produced video
+// didn't replace. A video that moved to another aspect ratio bucket leaves
+// its whole old directory behind; one that stayed put leaves the objects
+// the new run didn't overwrite, such as the old processed file or sprite
+// sheets past the end of a shorter video.
+func (cfg *apiConfig) deleteStaleOutputs(ctx context.Context, prev previousOutputs, video database.Video) {
+	if prev.key == "" {
+		return
+	}
+	if prev.objects == nil {
+		cfg.scheduleDeletion(ctx, database.DeletionKindObject, prev.key)
+		return
+	}
+	key, err := videoObjectKey(video)
+	if err != nil || path.Dir(key) != prev.dir {
+		for stale := range prev.objects {
+			cfg.scheduleDeletion(ctx, database.DeletionKindObject, stale)
+		}
+		return
+	}
+
+	objects, err := cfg.objectStore.List(ctx, prev.dir+"/")
+	if err != nil {
+		log.Printf("Couldn't list outputs of video %s: %v", video.ID, err)
+		cfg.scheduleDeletion(ctx, database.DeletionKindObject, prev.key)
+		return
+	}
+	for _, obj := range objects {
+		// Both times come from the store, so an unchanged one means the
+		// object wasn't written again.
+		if modified, ok := prev.objects[obj.Key]; ok && obj.LastModified.Equal(modified) {
+			cfg.scheduleDeletion(ctx, database.DeletionKindObject, obj.Key)
+		}
+	}
+}
+
+// scheduleDeletion records the deletion and makes a first attempt right
+// away. Failures are left in the queue for processPendingDeletions.
+func (cfg *apiConfig) scheduleDeletion(ctx context.Context, kind, key string) {
+	deletion, err := cfg.db.CreatePendingDeletion(kind, key)
+	if err != nil {
+		log.Printf("Couldn't queue deletion of %s %s: %v", kind, key, err)
+		return
+	}
+	cfg.attemptDeletion(ctx, deletion)
+}
+
+func (cfg *apiConfig) attemptDeletion(ctx context.Context, deletion database.PendingDeletion) {
+	err := cfg.deleteStoredFile(ctx, deletion.Kind, deletion.Key)
+	if err == nil {
+		if err := cfg.db.DeletePendingDeletion(deletion.ID); err != nil {
+			log.Printf("Couldn't clear pending deletion %s: %v", deletion.ID, err)
+		}
+		return
+	}
+
+	backoff := time.Minute << deletion.Attempts
+	if backoff <= 0 || backoff > maxDeletionBackoff {
+		backoff = maxDeletionBackoff
+	}
+	log.Printf("Couldn't delete %s %s (attempt %d): %v", deletion.Kind, deletion.Key, deletion.Attempts+1, err)
+	err = cfg.db.RetryPendingDeletion(deletion.ID, err.Error(), time.Now().UTC().Add(backoff))
+	if err != nil {
+		log.Printf("Couldn't reschedule deletion %s: %v", deletion.ID, err)
+	}
+}
+
+func (cfg *apiConfig) deleteStoredFile(ctx context.Context, kind, key string) error {
+	switch kind {
+	case database.DeletionKindObject:
+		err := cfg.objectStore.Delete(ctx, key)
+		if errors.Is(err, errObjectNotFound) {
+			return nil
+		}
+		return err
+	case database.DeletionKindAsset:
+		if key != filepath.Base(key) {
+			return fmt.Errorf("invalid asset path %q", key)
+		}
+		err := os.Remove(cfg.getAssetDiskPath(key))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown deletion kind %q", kind)
+	}
+}
+
+func (cfg *apiConfig) processPendingDeletions(ctx context.Context) {
+	deletions, err := cfg.db.GetDuePendingDeletions(time.Now().UTC(), pendingDeletionBatchSize)
+	if err != nil {
+		log.Printf("Couldn't list pending deletions: %v", err)
+		return
+	}
+	for _, deletion := range deletions {
+		cfg.attemptDeletion(ctx, deletion)
+	}
+}
+
+// managedObjectPrefixes returns the top-level directories this server
+// writes objects to. The sweeper looks nowhere else, so objects in a shared
+// bucket that aren't ours are never touched.
+func (cfg *apiConfig) managedObjectPrefixes() []string {
+	prefixes := []string{}
+	for _, prefix := range reservedKeyPrefixes {
+		prefixes = append(prefixes, prefix+"/")
+	}
+	for _, prefix := range cfg.processing.aspectRatio.keyPrefixes() {
+		prefixes = append(prefixes, prefix+"/")
+	}
+	slices.Sort(prefixes)
+	return slices.Compact(prefixes)
+}
+
+// sweepOrphans queues objects and assets that no video row refers to. Files
+// younger than grace are skipped so in-flight uploads aren't removed before
+// their row is updated.
+func (cfg *apiConfig) sweepOrphans(ctx context.Context, grace time.Duration) error {
+	refs, err := cfg.db.GetVideoReferences()
+	if err != nil {
+		return err
+	}
+	prefixes := []string{}
+	assets := map[string]bool{}
+	for _, ref := range refs {
+		prefixes = append(prefixes, videoStoragePrefixes(ref.ID, ref.VideoURL)...)
+		for _, name := range cfg.thumbnailAssetNames(ref.ThumbnailURL, ref.Thumbnails) {
+			assets[name] = true
+		}
+	}
+	watermarkKeys, err := cfg.db.GetWatermarkKeys()
+	if err != nil {
+		return err
+	}
+	prefixes = append(prefixes, watermarkKeys...)
+	if cfg.processing.watermark.key != "" {
+		prefixes = append(prefixes, cfg.processing.watermark.key)
+	}
+	cutoff := time.Now().Add(-grace)
+
+	for _, managed := range cfg.managedObjectPrefixes() {
+		objects, err := cfg.objectStore.List(ctx, managed)
+		if err != nil {
+			return fmt.Errorf("list %s: %w", managed, err)
+		}
+		for _, obj := range objects {
+			if obj.LastModified.After(cutoff) || isReferencedKey(obj.Key, prefixes) {
+				continue
+			}
+			cfg.scheduleDeletion(ctx, database.DeletionKindObject, obj.Key)
+		}
+	}
+
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		return fmt.Errorf("read assets: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || assets[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		cfg.scheduleDeletion(ctx, database.DeletionKindAsset, entry.Name())
+	}
+	return nil
+}
+
+func isReferencedKey(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if key == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// runStorageCleanup retries failed deletions every retryInterval and
+// sweeps for orphans every sweepInterval. A zero sweepInterval disables the
+// sweeper.
+func (cfg *apiConfig) runStorageCleanup(retryInterval, sweepInterval, grace time.Duration) {
+	go func() {
+		for range time.Tick(retryInterval) {
+			cfg.processPendingDeletions(context.Background())
+		}
+	}()
+	if sweepInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(sweepInterval) {
+			if err := cfg.sweepOrphans(context.Background(), grace); err != nil {
+				log.Printf("Orphan sweep failed: %v", err)
+			}
+		}
+	}()
+}
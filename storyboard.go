@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storyboards back the player's hover-scrub previews: a frame every
+// interval, tiled into JPEG sprite sheets, and a WebVTT track whose cues
+// point at each tile with a #xywh= fragment.
+
+const (
+	storyboardVTTName    = "storyboard.vtt"
+	storyboardSpriteName = "sprite-%03d.jpg"
+)
+
+type storyboardOptions struct {
+	interval  time.Duration
+	tileWidth int
+	columns   int
+	rows      int
+}
+
+// storyboardTile is where one sampled frame sits in the sheets.
+type storyboardTile struct {
+	start, end time.Duration
+	sheet      string
+	x, y       int
+}
+
+// storyboardLayout places a frame every opts.interval over duration into
+// sheets of columns x rows tiles of tileWidth x tileHeight.
+func storyboardLayout(duration time.Duration, tileHeight int, opts storyboardOptions) []storyboardTile {
+	frames := int(math.Ceil(float64(duration) / float64(opts.interval)))
+	perSheet := opts.columns * opts.rows
+	tiles := make([]storyboardTile, 0, frames)
+	for i := 0; i < frames; i++ {
+		n := i % perSheet
+		tiles = append(tiles, storyboardTile{
+			start: time.Duration(i) * opts.interval,
+			end:   min(time.Duration(i+1)*opts.interval, duration),
+			sheet: fmt.Sprintf(storyboardSpriteName, i/perSheet),
+			x:     (n % opts.columns) * opts.tileWidth,
+			y:     (n / opts.columns) * tileHeight,
+		})
+	}
+	return tiles
+}
+
+// storyboardVTT renders tiles as a WebVTT thumbnails track. Sheet names are
+// relative to the track.
+func storyboardVTT(tiles []storyboardTile, tileWidth, tileHeight int) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for _, tile := range tiles {
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(tile.start), vttTimestamp(tile.end),
+			tile.sheet, tile.x, tile.y, tileWidth, tileHeight)
+	}
+	return b.String()
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3_600_000, ms/60_000%60, ms/1000%60, ms%1000)
+}
+
+// generateStoryboard writes the sprite sheets and storyboard.vtt for the
+// video at filePath into outDir.
+func (cfg *apiConfig) generateStoryboard(ctx context.Context, filePath, outDir string, opts storyboardOptions) error {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	video, ok := probe.firstStream("video")
+	if !ok {
+		return fmt.Errorf("no video stream")
+	}
+	seconds, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil || seconds <= 0 {
+		return fmt.Errorf("video has no duration")
+	}
+	duration := time.Duration(seconds * float64(time.Second))
+
+	width, height := video.displayDimensions()
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("video has no dimensions")
+	}
+	// Even heights keep the JPEG encoder's chroma subsampling happy.
+	tileHeight := max(2, int(math.Round(float64(opts.tileWidth)*float64(height)/float64(width)/2))*2)
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d",
+		strconv.FormatFloat(opts.interval.Seconds(), 'f', -1, 64),
+		opts.tileWidth, tileHeight, opts.columns, opts.rows)
+	err = cfg.transcoder.Transcode(ctx,
+		"-i", filePath,
+		"-an",
+		"-vf", filter,
+		"-q:v", "5",
+		"-start_number", "0",
+		filepath.Join(outDir, storyboardSpriteName),
+	)
+	if err != nil {
+		return fmt.Errorf("render sprites: %w", err)
+	}
+
+	// ffmpeg's fps filter rounds, so the last frame can land on a sheet it
+	// never wrote; drop cues that would point at a missing file.
+	tiles := storyboardLayout(duration, tileHeight, opts)
+	for len(tiles) > 0 {
+		if _, err := os.Stat(filepath.Join(outDir, tiles[len(tiles)-1].sheet)); err == nil {
+			break
+		}
+		tiles = tiles[:len(tiles)-1]
+	}
+	if len(tiles) == 0 {
+		return fmt.Errorf("ffmpeg wrote no sprite sheets")
+	}
+	vtt := storyboardVTT(tiles, opts.tileWidth, tileHeight)
+	return os.WriteFile(filepath.Join(outDir, storyboardVTTName), []byte(vtt), 0644)
+}
+
+// runStoryboardStage builds the storyboard for the processed file and
+// uploads it under prefix/storyboard/. It returns the key of the track.
+func (cfg *apiConfig) runStoryboardStage(ctx context.Context, filePath, prefix string) (string, error) {
+	outDir, err := os.MkdirTemp(cfg.admission.scratchDir, "tubely-storyboard")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outDir)
+
+	if err := cfg.generateStoryboard(ctx, filePath, outDir, cfg.processing.storyboard); err != nil {
+		return "", err
+	}
+	if _, err := cfg.uploadDir(ctx, outDir, prefix+"/storyboard"); err != nil {
+		return "", err
+	}
+	return prefix + "/storyboard/" + storyboardVTTName, nil
+}
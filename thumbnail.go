@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Videos get a thumbnail extracted from the processed file unless the user
+// uploaded one. Extracted thumbnails are flagged so a later upload of the
+// video replaces them, while a user's own thumbnail is left alone.
+
+const (
+	thumbnailModeTimestamp = "timestamp"
+	thumbnailModeScene     = "scene"
+
+	// The scene mode lets ffmpeg's thumbnail filter pick the most
+	// representative frame out of this many.
+	thumbnailSceneFrames = 300
+)
+
+type thumbnailOptions struct {
+	mode string
+	at   time.Duration
+	// clamp falls back to the middle of a video shorter than at instead of
+	// failing.
+	clamp bool
+}
+
+type generateThumbnailPayload struct {
+	Mode      string   `json:"mode"`
+	Timestamp *float64 `json:"timestamp,omitempty"` // seconds
+}
+
+// extractThumbnail writes one JPEG frame of input to outPath. input can be
+// a local path or a URL ffmpeg can seek in.
+func (cfg *apiConfig) extractThumbnail(ctx context.Context, input, outPath string, opts thumbnailOptions) error {
+	probe, err := cfg.prober.Probe(ctx, input)
+	if err != nil {
+		return err
+	}
+	if _, ok := probe.firstStream("video"); !ok {
+		return fmt.Errorf("%w: no video stream", errPermanent)
+	}
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return fmt.Errorf("parse duration %q: %w", probe.Format.Duration, err)
+	}
+
+	var seek float64
+	args := []string{}
+	switch opts.mode {
+	case thumbnailModeScene:
+		// Skip the first tenth, where intros and fades tend to be.
+		seek = duration / 10
+		args = append(args, "-vf", fmt.Sprintf("thumbnail=n=%d", thumbnailSceneFrames))
+	case thumbnailModeTimestamp:
+		seek = opts.at.Seconds()
+		if seek >= duration && opts.clamp {
+			seek = duration / 2
+		}
+		if seek >= duration {
+			return fmt.Errorf("%w: timestamp %.2fs is past the end of the video (%.2fs)", errPermanent, seek, duration)
+		}
+	default:
+		return fmt.Errorf("%w: unknown thumbnail mode %q", errPermanent, opts.mode)
+	}
+
+	args = append([]string{"-ss", strconv.FormatFloat(seek, 'f', 3, 64), "-i", input}, args...)
+	args = append(args, "-frames:v", "1", "-q:v", "2", outPath)
+	return cfg.transcoder.Transcode(ctx, args...)
+}
+
+// generateThumbnail extracts a frame from input, runs it through the
+// thumbnail image pipeline and records it on the video. Unless force is set
+// it does nothing when the user has uploaded their own thumbnail.
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, videoID uuid.UUID, input string, opts thumbnailOptions, force bool) error {
+	frameFile, err := os.CreateTemp(cfg.admission.scratchDir, "tubely-frame*.jpg")
+	if err != nil {
+		return err
+	}
+	frameFile.Close()
+	defer os.Remove(frameFile.Name())
+	if err := cfg.extractThumbnail(ctx, input, frameFile.Name(), opts); err != nil {
+		return fmt.Errorf("extract thumbnail: %w", err)
+	}
+	frame, err := os.ReadFile(frameFile.Name())
+	if err != nil {
+		return err
+	}
+	return cfg.storeGeneratedThumbnail(ctx, videoID, frame, force)
+}
+
+// storeGeneratedThumbnail runs data, an encoded image, through the
+// thumbnail pipeline and records it on the video as generated, unless the
+// user has uploaded their own thumbnail and force isn't set.
+func (cfg *apiConfig) storeGeneratedThumbnail(ctx context.Context, videoID uuid.UUID, data []byte, force bool) error {
+	assetURL, thumbnails, err := cfg.storeThumbnailImages(data)
+	if err != nil {
+		return err
+	}
+	discard := func() {
+		for _, name := range cfg.thumbnailAssetNames(&assetURL, thumbnails) {
+			os.Remove(cfg.getAssetDiskPath(name))
+		}
+	}
+
+	// Re-read the video; the user may have uploaded a thumbnail while the
+	// image was being made.
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		discard()
+		return err
+	}
+	if video.ID == uuid.Nil || (!force && video.ThumbnailURL != nil && !video.ThumbnailGenerated) {
+		discard()
+		return nil
+	}
+
+	previous := cfg.thumbnailAssetNames(video.ThumbnailURL, video.Thumbnails)
+	video.ThumbnailURL = &assetURL
+	video.Thumbnails = thumbnails
+	video.ThumbnailGenerated = true
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		discard()
+		return err
+	}
+	for _, name := range previous {
+		cfg.scheduleDeletion(ctx, database.DeletionKindAsset, name)
+	}
+	return nil
+}
+
+// autoThumbnail is the processing pipeline's thumbnail step. A failure
+// here shouldn't fail the whole upload, so it's only logged.
+func (cfg *apiConfig) autoThumbnail(ctx context.Context, videoID uuid.UUID, videoPath string) {
+	opts := cfg.processing.thumbnail
+	opts.clamp = true
+	if err := cfg.generateThumbnail(ctx, videoID, videoPath, opts, false); err != nil {
+		log.Printf("Couldn't generate thumbnail for video %s: %v", videoID, err)
+	}
+}
+
+// runGenerateThumbnailJob regenerates the thumbnail from the stored video.
+// ffmpeg reads it through a presigned URL so only the frames it needs are
+// fetched.
+func (cfg *apiConfig) runGenerateThumbnailJob(ctx context.Context, videoID uuid.UUID, payload generateThumbnailPayload) error {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("%w: video %s no longer exists", errPermanent, videoID)
+	}
+	key, err := videoObjectKey(video)
+	if err != nil {
+		return fmt.Errorf("%w: video %s has no stored file", errPermanent, videoID)
+	}
+	url, err := cfg.objectStore.PresignGet(ctx, key, time.Hour)
+	if err != nil {
+		return fmt.Errorf("presign video: %w", err)
+	}
+
+	opts := thumbnailOptions{mode: payload.Mode}
+	if payload.Timestamp != nil {
+		opts.at = time.Duration(*payload.Timestamp * float64(time.Second))
+	}
+	return cfg.generateThumbnail(ctx, videoID, url, opts, true)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/chai2010/webp"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Thumbnails are never served as uploaded. storeThumbnailImages decodes the
+// image, applies its EXIF orientation and re-encodes it at each configured
+// width as JPEG and WebP. Re-encoding drops EXIF (GPS, camera serials) and
+// any other metadata the original carried.
+
+const (
+	thumbnailJPEGQuality = 82
+	thumbnailWebPQuality = 80
+)
+
+var thumbnailFormats = []struct {
+	name string
+	ext  string
+}{
+	{name: "jpeg", ext: ".jpg"},
+	{name: "webp", ext: ".webp"},
+}
+
+// storeThumbnailImages writes every variant of data into assetsRoot as
+// <id>-<width>.<ext>. It returns the URL of the largest JPEG, which becomes
+// the video's thumbnail_url, and the full set.
+func (cfg *apiConfig) storeThumbnailImages(data []byte) (string, database.Thumbnails, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("decode image: %w", err)
+	}
+	img = applyOrientation(flattenImage(img), jpegOrientation(data))
+
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", nil, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(randBytes)
+
+	thumbnails := database.Thumbnails{}
+	written := []string{}
+	cleanup := func() {
+		for _, name := range written {
+			os.Remove(cfg.getAssetDiskPath(name))
+		}
+	}
+	for _, width := range thumbnailWidths(cfg.processing.thumbnailWidths, img.Bounds().Dx()) {
+		resized := resizeImage(img, width)
+		for _, format := range thumbnailFormats {
+			var buf bytes.Buffer
+			switch format.name {
+			case "jpeg":
+				err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: thumbnailJPEGQuality})
+			case "webp":
+				err = webp.Encode(&buf, resized, &webp.Options{Quality: thumbnailWebPQuality})
+			}
+			if err != nil {
+				cleanup()
+				return "", nil, fmt.Errorf("encode %s: %w", format.name, err)
+			}
+			name := fmt.Sprintf("%s-%d%s", id, width, format.ext)
+			if err := os.WriteFile(cfg.getAssetDiskPath(name), buf.Bytes(), 0644); err != nil {
+				cleanup()
+				return "", nil, err
+			}
+			written = append(written, name)
+
+			set := thumbnails[format.name]
+			set.Images = append(set.Images, database.ThumbnailImage{
+				Width:  resized.Bounds().Dx(),
+				Height: resized.Bounds().Dy(),
+				URL:    cfg.getAssetURL(name),
+			})
+			thumbnails[format.name] = set
+		}
+	}
+
+	for name, set := range thumbnails {
+		srcset := []string{}
+		for _, img := range set.Images {
+			srcset = append(srcset, fmt.Sprintf("%s %dw", img.URL, img.Width))
+		}
+		set.Srcset = strings.Join(srcset, ", ")
+		thumbnails[name] = set
+	}
+	jpegs := thumbnails["jpeg"].Images
+	return jpegs[len(jpegs)-1].URL, thumbnails, nil
+}
+
+// thumbnailWidths keeps the configured widths that don't upscale the
+// source. An image narrower than all of them is kept at its own width.
+func thumbnailWidths(widths []int, sourceWidth int) []int {
+	fits := []int{}
+	for _, w := range widths {
+		if w <= sourceWidth {
+			fits = append(fits, w)
+		}
+	}
+	if len(fits) == 0 {
+		fits = append(fits, sourceWidth)
+	}
+	return fits
+}
+
+// thumbnailAssetNames lists every file under assetsRoot that belongs to a
+// video's thumbnail: each variant, plus thumbnail_url for thumbnails stored
+// before variants existed.
+func (cfg *apiConfig) thumbnailAssetNames(thumbnailURL *string, thumbnails database.Thumbnails) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(url *string) {
+		if name, ok := cfg.assetPathFromURL(url); ok && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	add(thumbnailURL)
+	for _, set := range thumbnails {
+		for _, img := range set.Images {
+			add(&img.URL)
+		}
+	}
+	return names
+}
+
+// flattenImage draws img onto white so transparent PNGs don't turn black
+// as JPEG.
+func flattenImage(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+func resizeImage(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if width == b.Dx() {
+		return img
+	}
+	height := max(1, (b.Dy()*width+b.Dx()/2)/b.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// applyOrientation turns src upright according to an EXIF orientation
+// value (1-8).
+func applyOrientation(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.SetRGBA(dx, dy, src.RGBAAt(x, y))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation tag of a JPEG, or 1 if data
+// isn't a JPEG or has no orientation.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xda || size < 2 || i+2+size > len(data) {
+			// Start of scan: metadata segments are all before it.
+			break
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 from the first IFD of a TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
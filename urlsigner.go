@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+// URLSigner turns an object key into a URL a browser can fetch.
+type URLSigner interface {
+	SignURL(ctx context.Context, key string, expireTime time.Duration) (string, error)
+}
+
+// cookieSigner is implemented by signers that can grant access to every
+// object under a key prefix at once, e.g. all HLS segments of a video.
+type cookieSigner interface {
+	SignCookies(prefix string, expireTime time.Duration) ([]*http.Cookie, error)
+}
+
+// storeURLSigner hands out the object store's own presigned URLs.
+type storeURLSigner struct {
+	store ObjectStore
+}
+
+func (s storeURLSigner) SignURL(ctx context.Context, key string, expireTime time.Duration) (string, error) {
+	return s.store.PresignGet(ctx, key, expireTime)
+}
+
+type cloudFrontConfig struct {
+	domain         string
+	keyPairID      string
+	privateKeyPath string
+	customPolicy   bool
+	cookieDomain   string
+}
+
+// cloudFrontSigner signs URLs for a CloudFront distribution in front of the
+// bucket. Canned policies produce shorter URLs; custom policies are needed
+// for wildcard resources, so cookies always use one.
+type cloudFrontSigner struct {
+	domain       string
+	customPolicy bool
+	urls         *sign.URLSigner
+	cookies      *sign.CookieSigner
+}
+
+func newCloudFrontSigner(cfg cloudFrontConfig) (*cloudFrontSigner, error) {
+	if cfg.domain == "" || cfg.keyPairID == "" || cfg.privateKeyPath == "" {
+		return nil, fmt.Errorf("cloudfront signer needs a domain, key pair id and private key")
+	}
+	privKey, err := sign.LoadPEMPrivKeyFile(cfg.privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load cloudfront private key: %w", err)
+	}
+	return &cloudFrontSigner{
+		domain:       strings.TrimSuffix(strings.TrimPrefix(cfg.domain, "https://"), "/"),
+		customPolicy: cfg.customPolicy,
+		urls:         sign.NewURLSigner(cfg.keyPairID, privKey),
+		cookies: sign.NewCookieSigner(cfg.keyPairID, privKey, func(o *sign.CookieOptions) {
+			o.Domain = cfg.cookieDomain
+			o.Path = "/"
+			o.Secure = true
+		}),
+	}, nil
+}
+
+func (s *cloudFrontSigner) resourceURL(key string) string {
+	return fmt.Sprintf("https://%s/%s", s.domain, key)
+}
+
+func (s *cloudFrontSigner) SignURL(ctx context.Context, key string, expireTime time.Duration) (string, error) {
+	resource := s.resourceURL(key)
+	expires := time.Now().Add(expireTime)
+	if !s.customPolicy {
+		return s.urls.Sign(resource, expires)
+	}
+	return s.urls.SignWithPolicy(resource, cloudFrontPolicy(resource, expires))
+}
+
+func (s *cloudFrontSigner) SignCookies(prefix string, expireTime time.Duration) ([]*http.Cookie, error) {
+	resource := s.resourceURL(strings.TrimSuffix(prefix, "/") + "/*")
+	return s.cookies.SignWithPolicy(cloudFrontPolicy(resource, time.Now().Add(expireTime)))
+}
+
+func cloudFrontPolicy(resource string, expires time.Time) *sign.Policy {
+	return &sign.Policy{
+		Statements: []sign.Statement{
+			{
+				Resource: resource,
+				Condition: sign.Condition{
+					DateLessThan: sign.NewAWSEpochTime(expires),
+				},
+			},
+		},
+	}
+}
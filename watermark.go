@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Published videos can carry a logo burned into every frame. A user's own
+// watermark wins; otherwise the deployment's, if WATERMARK_KEY names one.
+// The overlay runs on the normalized file, so every rendition made from it
+// is branded.
+
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// watermarkOptions is the deployment watermark, and the defaults for
+// settings a user upload leaves out.
+type watermarkOptions struct {
+	key      string
+	position string
+	opacity  float64
+	scale    float64
+}
+
+func validateWatermarkSettings(position string, opacity, scale float64) error {
+	if !slices.Contains(watermarkPositions, position) {
+		return fmt.Errorf("position must be one of %v", watermarkPositions)
+	}
+	if opacity <= 0 || opacity > 1 {
+		return fmt.Errorf("opacity must be greater than 0 and at most 1")
+	}
+	if scale <= 0 || scale > 1 {
+		return fmt.Errorf("scale must be greater than 0 and at most 1")
+	}
+	return nil
+}
+
+// watermarkFor returns the watermark to apply to userID's videos, or nil.
+func (cfg *apiConfig) watermarkFor(userID uuid.UUID) (*database.Watermark, error) {
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil || watermark != nil {
+		return watermark, err
+	}
+	deployment := cfg.processing.watermark
+	if deployment.key == "" {
+		return nil, nil
+	}
+	return &database.Watermark{
+		Key:      deployment.key,
+		Position: deployment.position,
+		Opacity:  deployment.opacity,
+		Scale:    deployment.scale,
+	}, nil
+}
+
+// watermarkOverlayPosition returns overlay filter x and y expressions that
+// keep the logo margin pixels from the chosen edges.
+func watermarkOverlayPosition(position string, margin int) (string, string) {
+	m := strconv.Itoa(margin)
+	switch position {
+	case "top-left":
+		return m, m
+	case "top-right":
+		return "main_w-overlay_w-" + m, m
+	case "bottom-left":
+		return m, "main_h-overlay_h-" + m
+	case "center":
+		return "(main_w-overlay_w)/2", "(main_h-overlay_h)/2"
+	default:
+		return "main_w-overlay_w-" + m, "main_h-overlay_h-" + m
+	}
+}
+
+// applyWatermark burns the image at logoPath into the video at filePath and
+// returns the path of the new file. Audio is copied untouched.
+func (cfg *apiConfig) applyWatermark(ctx context.Context, filePath, logoPath string, watermark database.Watermark) (string, error) {
+	probe, err := cfg.prober.Probe(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	video, ok := probe.firstStream("video")
+	if !ok {
+		return "", fmt.Errorf("%w: no video stream", errPermanent)
+	}
+	// ffmpeg rotates frames upright while decoding, so size the logo
+	// against what the viewer sees.
+	width, _ := video.displayDimensions()
+	logoWidth := max(2, int(math.Round(float64(width)*watermark.Scale)))
+	margin := int(math.Round(float64(width) * 0.03))
+	x, y := watermarkOverlayPosition(watermark.Position, margin)
+
+	filter := fmt.Sprintf(
+		"[1:v]scale=%d:-1,format=rgba,colorchannelmixer=aa=%.3f[wm];[0:v][wm]overlay=%s:%s:format=auto,format=yuv420p[v]",
+		logoWidth, watermark.Opacity, x, y)
+	output := filePath + ".watermarked"
+	err = cfg.transcoder.Transcode(ctx,
+		"-i", filePath,
+		"-i", logoPath,
+		"-filter_complex", filter,
+		"-map", "[v]",
+		"-map", "0:a:0?",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "20",
+		"-c:a", "copy",
+		"-movflags", "faststart",
+		"-f", "mp4",
+		output,
+	)
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+	return output, nil
+}
+
+// runWatermarkStage overlays the owner's watermark on the file at filePath.
+// It returns the path to use from here on, which the caller removes when it
+// differs from filePath.
+func (cfg *apiConfig) runWatermarkStage(ctx context.Context, video database.Video, filePath string) (string, error) {
+	if video.SourceVideoID != nil {
+		// Clips are cut from an already processed, and so already branded,
+		// video; a second pass would stack logos.
+		return filePath, nil
+	}
+	watermark, err := cfg.watermarkFor(video.UserID)
+	if err != nil {
+		return "", fmt.Errorf("get watermark: %w", err)
+	}
+	if watermark == nil {
+		return filePath, nil
+	}
+
+	logoPath, err := cfg.downloadObject(ctx, watermark.Key)
+	if errors.Is(err, errObjectNotFound) {
+		return "", fmt.Errorf("%w: watermark %s is missing", errPermanent, watermark.Key)
+	}
+	if err != nil {
+		return "", fmt.Errorf("download watermark: %w", err)
+	}
+	defer os.Remove(logoPath)
+
+	return cfg.applyWatermark(ctx, filePath, logoPath, *watermark)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Audio gets a waveform instead of frames: min/max peaks over a mono
+// downmix, stored as JSON for players to draw, and rendered once as a PNG
+// that stands in for the thumbnail.
+
+const (
+	waveformName = "waveform.json"
+	// waveformSampleRate is what the audio is decoded at before peaks are
+	// taken; far more than a few thousand points across need.
+	waveformSampleRate = 8000
+
+	waveformImageWidth  = 1280
+	waveformImageHeight = 720
+)
+
+var (
+	waveformBackground = color.RGBA{R: 0x1f, G: 0x23, B: 0x2b, A: 0xff}
+	waveformForeground = color.RGBA{R: 0x4f, G: 0xa3, B: 0xf7, A: 0xff}
+)
+
+// waveformData is the JSON format of BBC's audiowaveform, which players
+// such as peaks.js read directly. Data holds a min and a max per point,
+// scaled to 8 bits.
+type waveformData struct {
+	Version         int   `json:"version"`
+	Channels        int   `json:"channels"`
+	SampleRate      int   `json:"sample_rate"`
+	SamplesPerPixel int   `json:"samples_per_pixel"`
+	Bits            int   `json:"bits"`
+	Length          int   `json:"length"`
+	Data            []int `json:"data"`
+}
+
+// generateWaveform decodes input to mono PCM and reduces it to about points
+// min/max pairs. duration sizes the buckets.
+func (cfg *apiConfig) generateWaveform(ctx context.Context, input string, duration time.Duration, points int) (waveformData, error) {
+	pcm, err := os.CreateTemp(cfg.admission.scratchDir, "tubely-waveform*.pcm")
+	if err != nil {
+		return waveformData{}, err
+	}
+	pcm.Close()
+	defer os.Remove(pcm.Name())
+
+	err = cfg.transcoder.Transcode(ctx,
+		"-i", input,
+		"-map", "0:a:0",
+		"-ac", "1",
+		"-ar", strconv.Itoa(waveformSampleRate),
+		"-c:a", "pcm_s16le",
+		"-f", "s16le",
+		pcm.Name(),
+	)
+	if err != nil {
+		return waveformData{}, err
+	}
+
+	samples := int(math.Ceil(duration.Seconds() * waveformSampleRate))
+	samplesPerPoint := max(1, (samples+points-1)/points)
+	f, err := os.Open(pcm.Name())
+	if err != nil {
+		return waveformData{}, err
+	}
+	defer f.Close()
+	peaks, err := waveformPeaks(bufio.NewReader(f), samplesPerPoint)
+	if err != nil {
+		return waveformData{}, err
+	}
+	return waveformData{
+		Version:         2,
+		Channels:        1,
+		SampleRate:      waveformSampleRate,
+		SamplesPerPixel: samplesPerPoint,
+		Bits:            8,
+		Length:          len(peaks) / 2,
+		Data:            peaks,
+	}, nil
+}
+
+// waveformPeaks reads signed 16-bit little-endian samples from r and
+// returns the min and max of every samplesPerPoint of them, scaled to
+// -128..127.
+func waveformPeaks(r io.Reader, samplesPerPoint int) ([]int, error) {
+	peaks := []int{}
+	lo, hi, n := int16(math.MaxInt16), int16(math.MinInt16), 0
+	flush := func() {
+		peaks = append(peaks, int(lo>>8), int(hi>>8))
+		lo, hi, n = math.MaxInt16, math.MinInt16, 0
+	}
+	var buf [2]byte
+	for {
+		_, err := io.ReadFull(r, buf[:])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sample := int16(binary.LittleEndian.Uint16(buf[:]))
+		lo, hi = min(lo, sample), max(hi, sample)
+		n++
+		if n == samplesPerPoint {
+			flush()
+		}
+	}
+	if n > 0 {
+		flush()
+	}
+	return peaks, nil
+}
+
+// renderWaveform draws the peaks as a centred bar per column and encodes
+// the result as PNG.
+func renderWaveform(waveform waveformData, width, height int) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: waveformBackground}, image.Point{}, draw.Src)
+
+	mid := height / 2
+	// Leave a margin so full-scale peaks don't touch the edges.
+	scale := float64(height) * 0.45 / 128
+	fg := &image.Uniform{C: waveformForeground}
+	for x := 0; x < width; x++ {
+		top, bottom := mid, mid+1
+		if waveform.Length > 0 {
+			i := x * waveform.Length / width
+			lo, hi := waveform.Data[2*i], waveform.Data[2*i+1]
+			top = mid - int(math.Round(float64(hi)*scale))
+			bottom = max(mid-int(math.Round(float64(lo)*scale)), top+1)
+		}
+		draw.Draw(img, image.Rect(x, top, x+1, bottom), fg, image.Point{}, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}